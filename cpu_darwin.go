@@ -0,0 +1,114 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"github.com/ebitengine/purego"
+	"golang.org/x/sys/unix"
+)
+
+// Mach constants from <mach/processor_info.h> and <mach/machine.h>
+const (
+	processorCPULoadInfo = 2 // PROCESSOR_CPU_LOAD_INFO
+	cpuStateMax          = 4 // CPU_STATE_MAX
+	cpuStateUser         = 0
+	cpuStateSystem       = 1
+	cpuStateIdle         = 2
+	cpuStateNice         = 3
+)
+
+// Per-core ticks are only available from the Mach host_processor_info call, macOS has
+// no sysctl for them. The Mach calls are resolved from libSystem at runtime, so the
+// build needs no cgo.
+var (
+	machHostSelf      func() uint32
+	hostProcessorInfo func(host uint32, flavor int32, count *uint32, info *unsafe.Pointer, infoCount *uint32) int32
+	vmDeallocate      func(task uint32, address uintptr, size uintptr) int32
+	machTaskSelf      uint32
+
+	machOnce sync.Once
+	machErr  error
+)
+
+func loadMach() error {
+	machOnce.Do(func() {
+		lib, err := purego.Dlopen("/usr/lib/libSystem.B.dylib", purego.RTLD_NOW|purego.RTLD_GLOBAL)
+		if err != nil {
+			machErr = fmt.Errorf("failed to load libSystem: %w", err)
+			return
+		}
+
+		// mach_task_self() is a macro for the mach_task_self_ global
+		taskSelf, err := purego.Dlsym(lib, "mach_task_self_")
+		if err != nil {
+			machErr = fmt.Errorf("failed to find mach_task_self_: %w", err)
+			return
+		}
+		machTaskSelf = **(**uint32)(unsafe.Pointer(&taskSelf))
+
+		purego.RegisterLibFunc(&machHostSelf, lib, "mach_host_self")
+		purego.RegisterLibFunc(&hostProcessorInfo, lib, "host_processor_info")
+		purego.RegisterLibFunc(&vmDeallocate, lib, "vm_deallocate")
+	})
+	return machErr
+}
+
+// getCPUTicks returns the cumulative tick counters of every logical CPU
+// using the Mach host_processor_info call
+func getCPUTicks() ([]cpuTicks, error) {
+	if err := loadMach(); err != nil {
+		return nil, err
+	}
+
+	var count, infoCount uint32
+	var info unsafe.Pointer
+
+	ret := hostProcessorInfo(machHostSelf(), processorCPULoadInfo, &count, &info, &infoCount)
+	if ret != 0 {
+		return nil, fmt.Errorf("host_processor_info failed: %d", ret)
+	}
+	defer vmDeallocate(machTaskSelf, uintptr(info), uintptr(infoCount)*unsafe.Sizeof(int32(0)))
+
+	loads := unsafe.Slice((*[cpuStateMax]uint32)(info), int(count))
+
+	ticks := make([]cpuTicks, len(loads))
+	for i, load := range loads {
+		ticks[i] = cpuTicks{
+			user:   load[cpuStateUser],
+			system: load[cpuStateSystem],
+			idle:   load[cpuStateIdle],
+			nice:   load[cpuStateNice],
+		}
+	}
+
+	return ticks, nil
+}
+
+// getLoadAverage returns the 1, 5 and 15 minute load averages from the vm.loadavg
+// sysctl: struct loadavg { fixpt_t ldavg[3]; long fscale; }
+func getLoadAverage() ([3]float64, error) {
+	var loads [3]float64
+
+	raw, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return loads, fmt.Errorf("sysctl vm.loadavg failed: %w", err)
+	}
+	if len(raw) < 24 {
+		return loads, fmt.Errorf("sysctl vm.loadavg returned %d bytes", len(raw))
+	}
+
+	fscale := float64(binary.LittleEndian.Uint64(raw[16:24]))
+	if fscale == 0 {
+		return loads, fmt.Errorf("sysctl vm.loadavg returned a zero scale")
+	}
+	for i := range loads {
+		loads[i] = float64(binary.LittleEndian.Uint32(raw[i*4:])) / fscale
+	}
+
+	return loads, nil
+}
@@ -0,0 +1,15 @@
+//go:build !darwin
+
+package main
+
+import "fmt"
+
+// getCPUTicks needs the Mach host_processor_info call, which is only available on macOS
+func getCPUTicks() ([]cpuTicks, error) {
+	return nil, fmt.Errorf("CPU tick counters are only available on macOS")
+}
+
+// getLoadAverage reads the vm.loadavg sysctl, which is only available on macOS
+func getLoadAverage() ([3]float64, error) {
+	return [3]float64{}, fmt.Errorf("load average is only available on macOS")
+}
@@ -0,0 +1,61 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const (
+	// mntNoWait makes getfsstat return cached statistics instead of blocking on
+	// unresponsive network mounts
+	mntNoWait = 2
+
+	// mntDontBrowse marks mounts hidden from Finder, such as the APFS system support volumes
+	mntDontBrowse = 0x00100000
+)
+
+// getMountedVolumes returns usage for the boot volume and every browsable mount
+// (external disks, disk images and network shares) using getfsstat
+func getMountedVolumes() ([]volumeUsage, error) {
+	n, err := syscall.Getfsstat(nil, mntNoWait)
+	if err != nil {
+		return nil, fmt.Errorf("getfsstat failed: %w", err)
+	}
+
+	buf := make([]syscall.Statfs_t, n)
+	n, err = syscall.Getfsstat(buf, mntNoWait)
+	if err != nil {
+		return nil, fmt.Errorf("getfsstat failed: %w", err)
+	}
+
+	var volumes []volumeUsage
+	for _, fs := range buf[:n] {
+		mountPoint := cString(fs.Mntonname[:])
+		fsType := cString(fs.Fstypename[:])
+
+		if mountPoint != "/" && fs.Flags&mntDontBrowse != 0 {
+			continue
+		}
+		if fsType == "devfs" || fsType == "autofs" || fs.Blocks == 0 {
+			continue
+		}
+
+		volumes = append(volumes, newVolumeUsage(mountPoint, fsType, cString(fs.Mntfromname[:]),
+			fs.Blocks*uint64(fs.Bsize), fs.Bavail*uint64(fs.Bsize)))
+	}
+
+	return volumes, nil
+}
+
+func cString(b []int8) string {
+	s := make([]byte, 0, len(b))
+	for _, c := range b {
+		if c == 0 {
+			break
+		}
+		s = append(s, byte(c))
+	}
+	return string(s)
+}
@@ -0,0 +1,57 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// pseudoFilesystems are skipped when listing mounts on Linux
+var pseudoFilesystems = map[string]bool{
+	"proc": true, "sysfs": true, "devtmpfs": true, "devpts": true, "tmpfs": true,
+	"cgroup": true, "cgroup2": true, "securityfs": true, "pstore": true, "debugfs": true,
+	"tracefs": true, "mqueue": true, "hugetlbfs": true, "configfs": true, "fusectl": true,
+	"bpf": true, "autofs": true, "binfmt_misc": true, "nsfs": true, "overlay": true, "squashfs": true,
+}
+
+// getMountedVolumes returns usage for every real filesystem in /proc/mounts using statfs.
+// Linux is supported for testing the disk sensors away from a Mac.
+func getMountedVolumes() ([]volumeUsage, error) {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /proc/mounts: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var volumes []volumeUsage
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		device, mountPoint, fsType := fields[0], unescapeMountPoint(fields[1]), fields[2]
+		if pseudoFilesystems[fsType] || seen[mountPoint] {
+			continue
+		}
+
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(mountPoint, &fs); err != nil || fs.Blocks == 0 {
+			continue
+		}
+		seen[mountPoint] = true
+
+		volumes = append(volumes, newVolumeUsage(mountPoint, fsType, device,
+			fs.Blocks*uint64(fs.Bsize), fs.Bavail*uint64(fs.Bsize)))
+	}
+
+	return volumes, nil
+}
+
+// unescapeMountPoint decodes the octal escapes /proc/mounts uses for spaces and tabs
+func unescapeMountPoint(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
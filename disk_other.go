@@ -0,0 +1,9 @@
+//go:build !darwin && !linux
+
+package main
+
+import "fmt"
+
+func getMountedVolumes() ([]volumeUsage, error) {
+	return nil, fmt.Errorf("disk usage is not supported on this platform")
+}
@@ -3,7 +3,9 @@ module github.com/bessarabov/mac2mqtt
 go 1.22.0
 
 require (
+	github.com/ebitengine/purego v0.8.4
 	github.com/eclipse/paho.mqtt.golang v1.4.3
+	golang.org/x/sys v0.28.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
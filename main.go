@@ -1,21 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -26,16 +33,22 @@ var (
 	hostname   string
 	debugMode  bool
 	dryRunMode bool
+	volumeStep = 5 // Step used by "up"/"down" volume commands
+	cpuPerCore bool
+
+	networkPerInterface bool
+	networkRate         = networkRateUnits["KB/s"]
+	networkSmoothing    = 1 // Number of samples averaged into each published rate
 )
 
-// networkStats holds network interface statistics for rate calculation
+// networkStats holds the last netstat sample of every interface for rate calculation
 type networkStats struct {
-	bytesIn    int64
-	bytesOut   int64
-	timestamp  time.Time
-	uploadRate float64   // bytes per second
-	downloadRate float64 // bytes per second
-	mu         sync.Mutex
+	counters  map[string]interfaceCounters
+	rates     map[string]interfaceRates
+	history   map[string][]interfaceRates // Recent samples for the moving average
+	primary   string
+	timestamp time.Time
+	mu        sync.Mutex
 }
 
 var netStats = &networkStats{}
@@ -48,6 +61,12 @@ type config struct {
 	Debug      bool   `yaml:"debug"`
 	DryRun     bool   `yaml:"dry_run"`
 	AutoUpdate *bool  `yaml:"auto_update"` // Pointer: nil = default true
+	VolumeStep int    `yaml:"volume_step"`
+	CPUPerCore bool   `yaml:"cpu_per_core"`
+
+	NetworkPerInterface  bool   `yaml:"network_per_interface"`
+	NetworkRateUnit      string `yaml:"network_rate_unit"`
+	NetworkRateSmoothing int    `yaml:"network_rate_smoothing"`
 }
 
 func (c *config) getConfig() *config {
@@ -66,6 +85,25 @@ func (c *config) getConfig() *config {
 	debugMode = c.Debug
 	dryRunMode = c.DryRun
 
+	cpuPerCore = c.CPUPerCore
+	networkPerInterface = c.NetworkPerInterface
+
+	if c.NetworkRateUnit != "" {
+		if unit, ok := networkRateUnits[c.NetworkRateUnit]; ok {
+			networkRate = unit
+		} else {
+			log.Printf("Warning: unknown network_rate_unit %q, using KB/s", c.NetworkRateUnit)
+		}
+	}
+
+	if c.NetworkRateSmoothing > 1 {
+		networkSmoothing = c.NetworkRateSmoothing
+	}
+
+	if c.VolumeStep > 0 {
+		volumeStep = c.VolumeStep
+	}
+
 	if dryRunMode {
 		log.Println("DRY RUN MODE ENABLED - No actual MQTT connection will be made")
 	}
@@ -135,28 +173,80 @@ func tryGetCommandOutput(name string, arg ...string) (string, error) {
 	return strings.TrimSuffix(string(stdout), "\n"), nil
 }
 
-func getMuteStatus() bool {
-	output := getCommandOutput("/usr/bin/osascript", "-e", "output muted of (get volume settings)")
+// volumeSettings is the record returned by AppleScript's `get volume settings`.
+// A level is -1 when the device reports "missing value" (e.g. HDMI outputs have no volume).
+type volumeSettings struct {
+	output int
+	input  int
+	alert  int
+	muted  bool
+}
 
-	b, err := strconv.ParseBool(output)
-	if err != nil {
-		log.Fatal(err)
-	}
+func getVolumeSettings() volumeSettings {
+	output := getCommandOutput("/usr/bin/osascript", "-e", "get volume settings")
 
-	return b
+	return parseVolumeSettings(output)
 }
 
-func getCurrentVolume() int {
-	output := getCommandOutput("/usr/bin/osascript", "-e", "output volume of (get volume settings)")
+// parseVolumeSettings parses the record, e.g.
+// output volume:50, input volume:75, alert volume:100, output muted:false
+func parseVolumeSettings(output string) volumeSettings {
+	s := volumeSettings{output: -1, input: -1, alert: -1}
 
-	i, err := strconv.Atoi(output)
-	if err != nil {
-		log.Fatal(err)
+	for _, field := range strings.Split(output, ",") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(kv[0])
+		value := strings.TrimSpace(kv[1])
+
+		switch key {
+		case "output volume":
+			s.output = parseVolumeLevel(value)
+		case "input volume":
+			s.input = parseVolumeLevel(value)
+		case "alert volume":
+			s.alert = parseVolumeLevel(value)
+		case "output muted":
+			s.muted, _ = strconv.ParseBool(value)
+		}
 	}
 
+	return s
+}
+
+func parseVolumeLevel(value string) int {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return -1
+	}
 	return i
 }
 
+func getCurrentVolume() int {
+	return getVolumeSettings().output
+}
+
+// helperDirs are the usual install locations of optional Homebrew helper tools.
+// launchd starts mac2mqtt with a minimal PATH, so they are looked up explicitly.
+var helperDirs = []string{
+	"/opt/homebrew/bin",
+	"/usr/local/bin",
+}
+
+// findHelper returns the path of an optional helper tool, or "" when it is not installed
+func findHelper(name string) string {
+	for _, dir := range helperDirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
 func runCommand(name string, arg ...string) {
 	cmd := exec.Command(name, arg...)
 
@@ -171,6 +261,150 @@ func setVolume(i int) {
 	runCommand("/usr/bin/osascript", "-e", "set volume output volume "+strconv.Itoa(i))
 }
 
+// from 0 to 100
+func setInputVolume(i int) {
+	runCommand("/usr/bin/osascript", "-e", "set volume input volume "+strconv.Itoa(i))
+}
+
+// from 0 to 100
+func setAlertVolume(i int) {
+	runCommand("/usr/bin/osascript", "-e", "set volume alert volume "+strconv.Itoa(i))
+}
+
+// volumeValueSchema accepts "+5"/"-10", an absolute 0-100 level, or "up"/"down"
+var volumeValueSchema = oneOfSchema(
+	patternSchema(`^[+-]\d+$`),
+	intSchema(0, 100),
+	enumSchema("up", "down"),
+)
+
+// volumeSchema additionally accepts {"volume": <value>, "fade": <seconds>}
+var volumeSchema = oneOfSchema(append(volumeValueSchema.OneOf, jsonSchema())...)
+
+const (
+	volumeFadeInterval = 200 * time.Millisecond
+	maxVolumeFade      = 5 * time.Minute
+)
+
+// volumeFade tracks the running fade so that a newer volume command cancels it
+var volumeFade struct {
+	generation int
+	mu         sync.Mutex
+}
+
+// resolveVolumeTarget converts a parsed command/volume payload into the
+// target volume (0-100) and the fade duration
+func resolveVolumeTarget(value interface{}, current int) (int, time.Duration, error) {
+	switch v := value.(type) {
+	case int:
+		return v, 0, nil
+
+	case string:
+		delta := 0
+		switch v {
+		case "up":
+			delta = volumeStep
+		case "down":
+			delta = -volumeStep
+		default:
+			d, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, 0, err
+			}
+			delta = d
+		}
+		return clampVolume(current + delta), 0, nil
+
+	case json.RawMessage:
+		var req struct {
+			Volume interface{} `json:"volume"`
+			Fade   float64     `json:"fade"`
+		}
+		if err := json.Unmarshal(v, &req); err != nil {
+			return 0, 0, err
+		}
+
+		fade := time.Duration(req.Fade * float64(time.Second))
+		if fade < 0 || fade > maxVolumeFade {
+			return 0, 0, fmt.Errorf("fade must be between 0 and %v", maxVolumeFade)
+		}
+
+		var raw string
+		switch vol := req.Volume.(type) {
+		case float64:
+			raw = strconv.FormatFloat(vol, 'f', -1, 64)
+		case string:
+			raw = vol
+		default:
+			return 0, 0, fmt.Errorf("missing or invalid \"volume\" field")
+		}
+
+		inner, err := volumeValueSchema.parse(raw)
+		if err != nil {
+			return 0, 0, err
+		}
+		target, _, err := resolveVolumeTarget(inner, current)
+		return target, fade, err
+	}
+
+	return 0, 0, fmt.Errorf("unsupported volume value %v", value)
+}
+
+func clampVolume(i int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > 100 {
+		return 100
+	}
+	return i
+}
+
+func handleVolumeCommand(client mqtt.Client, value interface{}) {
+	current := getCurrentVolume()
+	if current < 0 {
+		log.Println("Output device does not support volume control")
+		return
+	}
+
+	target, fade, err := resolveVolumeTarget(value, current)
+	if err != nil {
+		log.Printf("Incorrect value for command volume: %v", err)
+		return
+	}
+
+	volumeFade.mu.Lock()
+	volumeFade.generation++
+	generation := volumeFade.generation
+	volumeFade.mu.Unlock()
+
+	steps := int(fade / volumeFadeInterval)
+	if steps < 1 || target == current {
+		setVolume(target)
+
+		updateVolumeSettings(client)
+		return
+	}
+
+	// Ramp in the background so the MQTT callback is not blocked for the whole fade
+	go func() {
+		for i := 1; i <= steps; i++ {
+			time.Sleep(volumeFadeInterval)
+
+			volumeFade.mu.Lock()
+			cancelled := volumeFade.generation != generation
+			volumeFade.mu.Unlock()
+			if cancelled {
+				return
+			}
+
+			setVolume(current + (target-current)*i/steps)
+		}
+
+		updateVolumeSettings(client)
+	}()
+}
+
 // true - turn mute on
 // false - turn mute off
 func setMute(b bool) {
@@ -254,17 +488,22 @@ var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Me
 	log.Printf("Received message: %s from topic: %s\n", msg.Payload(), msg.Topic())
 }
 
-func publishDiscoveryMessages(client mqtt.Client) {
-	prefix := getTopicPrefix()
-
-	// Device information shared across all entities
-	device := map[string]interface{}{
+// getDeviceInfo returns the Home Assistant device information shared across all entities
+func getDeviceInfo() map[string]interface{} {
+	return map[string]interface{}{
 		"identifiers":  []string{"mac2mqtt_" + hostname},
 		"name":         hostname,
 		"model":        "macOS Computer",
 		"manufacturer": "Apple",
 		"sw_version":   version,
 	}
+}
+
+func publishDiscoveryMessages(client mqtt.Client) {
+	prefix := getTopicPrefix()
+
+	// Device information shared across all entities
+	device := getDeviceInfo()
 
 	// Binary sensor for alive status
 	aliveConfig := map[string]interface{}{
@@ -278,19 +517,135 @@ func publishDiscoveryMessages(client mqtt.Client) {
 	}
 	publishConfig(client, "binary_sensor", hostname+"_alive", aliveConfig)
 
-	// Sensor for battery
-	batteryConfig := map[string]interface{}{
-		"name":                  "Battery",
-		"unique_id":             "mac2mqtt_" + hostname + "_battery",
-		"state_topic":           prefix + "/status/battery",
-		"unit_of_measurement":   "%",
-		"device_class":          "battery",
+	batteryPresent, batteryKnown := checkBattery()
+	if batteryPresent {
+		// Sensor for battery
+		batteryConfig := map[string]interface{}{
+			"name":                  "Battery",
+			"unique_id":             "mac2mqtt_" + hostname + "_battery",
+			"state_topic":           prefix + "/status/battery",
+			"unit_of_measurement":   "%",
+			"device_class":          "battery",
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_battery", batteryConfig)
+
+		// Sensor for Battery Temperature
+		battTempConfig := map[string]interface{}{
+			"name":                  "Battery Temperature",
+			"unique_id":             "mac2mqtt_" + hostname + "_battery_temperature",
+			"state_topic":           prefix + "/status/battery_temperature",
+			"unit_of_measurement":   "°C",
+			"device_class":          "temperature",
+			"icon":                  "mdi:thermometer",
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_battery_temperature", battTempConfig)
+
+		// Sensors for battery health telemetry
+		publishBatteryEntities(client, device)
+
+		// Sensors for power draw and accumulated energy (eligible for the energy dashboard)
+		powerConfig := map[string]interface{}{
+			"name":                        "Power",
+			"unique_id":                   "mac2mqtt_" + hostname + "_power",
+			"state_topic":                 prefix + "/status/power",
+			"unit_of_measurement":         "W",
+			"device_class":                "power",
+			"state_class":                 "measurement",
+			"suggested_display_precision": 1,
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		publishConfig(client, "sensor", hostname+"_power", powerConfig)
+
+		energyConfig := map[string]interface{}{
+			"name":                        "Energy",
+			"unique_id":                   "mac2mqtt_" + hostname + "_energy",
+			"state_topic":                 prefix + "/status/energy",
+			"unit_of_measurement":         "kWh",
+			"device_class":                "energy",
+			"state_class":                 "total_increasing",
+			"suggested_display_precision": 3,
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		publishConfig(client, "sensor", hostname+"_energy", energyConfig)
+	} else if batteryKnown {
+		// Retire battery entities announced by earlier versions on Macs without a battery.
+		// Never on a failed ioreg read, that would delete the entities of a laptop.
+		removeConfig(client, "sensor", hostname+"_battery")
+		removeConfig(client, "sensor", hostname+"_battery_temperature")
+		for _, e := range batteryEntities {
+			removeConfig(client, "sensor", hostname+"_"+e.id)
+		}
+	}
+
+	// Binary sensor, sensor and event for power source
+	acPowerConfig := map[string]interface{}{
+		"name":                  "AC Power",
+		"unique_id":             "mac2mqtt_" + hostname + "_ac_power",
+		"state_topic":           prefix + "/status/ac_power",
+		"payload_on":            "true",
+		"payload_off":           "false",
+		"device_class":          "plug",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "binary_sensor", hostname+"_ac_power", acPowerConfig)
+
+	powerSourceConfig := map[string]interface{}{
+		"name":                  "Power Source",
+		"unique_id":             "mac2mqtt_" + hostname + "_power_source",
+		"state_topic":           prefix + "/status/power_source",
+		"icon":                  "mdi:power-plug-battery",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_power_source", powerSourceConfig)
+
+	powerSourceEventConfig := map[string]interface{}{
+		"name":                  "Power Source Event",
+		"unique_id":             "mac2mqtt_" + hostname + "_power_source_event",
+		"state_topic":           prefix + "/status/power_source_event",
+		"event_types":           []string{"plugged_in", "unplugged"},
+		"icon":                  "mdi:power-plug-off",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_battery", batteryConfig)
+	publishConfig(client, "event", hostname+"_power_source_event", powerSourceEventConfig)
+
+	if hasBattery() {
+		// The adapter wattage is the Power Adapter sensor of the battery telemetry
+		adapterNameConfig := map[string]interface{}{
+			"name":                  "Power Adapter Name",
+			"unique_id":             "mac2mqtt_" + hostname + "_power_adapter_name",
+			"state_topic":           prefix + "/status/power_adapter_name",
+			"icon":                  "mdi:power-plug-outline",
+			"entity_category":       "diagnostic",
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_power_adapter_name", adapterNameConfig)
+	}
 
 	// Sensor for volume (read-only)
 	volumeSensorConfig := map[string]interface{}{
@@ -339,6 +694,219 @@ func publishDiscoveryMessages(client mqtt.Client) {
 	}
 	publishConfig(client, "number", hostname+"_volume", volumeConfig)
 
+	// Buttons for stepped volume
+	volumeUpConfig := map[string]interface{}{
+		"name":                  "Volume Up",
+		"unique_id":             "mac2mqtt_" + hostname + "_volume_up",
+		"command_topic":         prefix + "/command/volume",
+		"payload_press":         "up",
+		"icon":                  "mdi:volume-plus",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "button", hostname+"_volume_up", volumeUpConfig)
+
+	volumeDownConfig := map[string]interface{}{
+		"name":                  "Volume Down",
+		"unique_id":             "mac2mqtt_" + hostname + "_volume_down",
+		"command_topic":         prefix + "/command/volume",
+		"payload_press":         "down",
+		"icon":                  "mdi:volume-minus",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "button", hostname+"_volume_down", volumeDownConfig)
+
+	// Sensors and numbers for microphone input volume and alert volume
+	for _, v := range []struct {
+		id   string
+		name string
+		icon string
+	}{
+		{"input_volume", "Input Volume", "mdi:microphone"},
+		{"alert_volume", "Alert Volume", "mdi:bell-ring"},
+	} {
+		levelConfig := map[string]interface{}{
+			"name":                  v.name + " Level",
+			"unique_id":             "mac2mqtt_" + hostname + "_" + v.id + "_sensor",
+			"state_topic":           prefix + "/status/" + v.id,
+			"unit_of_measurement":   "%",
+			"icon":                  v.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+v.id+"_sensor", levelConfig)
+
+		numberConfig := map[string]interface{}{
+			"name":                  v.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + v.id,
+			"state_topic":           prefix + "/status/" + v.id,
+			"command_topic":         prefix + "/command/" + v.id,
+			"min":                   0,
+			"max":                   100,
+			"step":                  1,
+			"icon":                  v.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "number", hostname+"_"+v.id, numberConfig)
+	}
+
+	// Sensors for current audio devices
+	audioOutputConfig := map[string]interface{}{
+		"name":                  "Audio Output Device",
+		"unique_id":             "mac2mqtt_" + hostname + "_audio_output_device_sensor",
+		"state_topic":           prefix + "/status/audio_output_device",
+		"icon":                  "mdi:speaker",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_audio_output_device_sensor", audioOutputConfig)
+
+	audioInputConfig := map[string]interface{}{
+		"name":                  "Audio Input Device",
+		"unique_id":             "mac2mqtt_" + hostname + "_audio_input_device_sensor",
+		"state_topic":           prefix + "/status/audio_input_device",
+		"icon":                  "mdi:microphone",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_audio_input_device_sensor", audioInputConfig)
+
+	// Sensors and event for connected displays
+	displayCountConfig := map[string]interface{}{
+		"name":                  "Displays",
+		"unique_id":             "mac2mqtt_" + hostname + "_display_count",
+		"state_topic":           prefix + "/status/display_count",
+		"json_attributes_topic": prefix + "/status/displays",
+		"state_class":           "measurement",
+		"icon":                  "mdi:monitor-multiple",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_display_count", displayCountConfig)
+
+	displayResolutionConfig := map[string]interface{}{
+		"name":                  "Main Display Resolution",
+		"unique_id":             "mac2mqtt_" + hostname + "_display_resolution",
+		"state_topic":           prefix + "/status/display_resolution",
+		"icon":                  "mdi:monitor-screenshot",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_display_resolution", displayResolutionConfig)
+
+	displayEventConfig := map[string]interface{}{
+		"name":                  "Display Event",
+		"unique_id":             "mac2mqtt_" + hostname + "_display_event",
+		"state_topic":           prefix + "/status/display_event",
+		"event_types":           []string{"connected", "disconnected"},
+		"icon":                  "mdi:monitor-shimmer",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "event", hostname+"_display_event", displayEventConfig)
+
+	// Selects for audio devices and brightness numbers depend on the devices currently available
+	audioDevices.forgetPublished()
+	brightness.forgetPublished()
+
+	// Disk sensors are published per mounted volume
+	disks.forgetPublished()
+
+	// Per-interface network sensors depend on the interfaces currently active
+	netInterfaces.forgetPublished()
+
+	// Bluetooth device entities depend on the paired devices
+	bluetooth.forgetPublished()
+
+	// VPN binary sensors depend on the configured services
+	vpns.forgetPublished()
+
+	// Sensors for now playing media
+	mediaStateConfig := map[string]interface{}{
+		"name":                  "Media State",
+		"unique_id":             "mac2mqtt_" + hostname + "_media_state",
+		"state_topic":           prefix + "/status/media_state",
+		"device_class":          "enum",
+		"options":               []string{"playing", "paused", "stopped", "idle"},
+		"icon":                  "mdi:play-pause",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_media_state", mediaStateConfig)
+
+	for _, m := range []struct {
+		id   string
+		name string
+		icon string
+	}{
+		{"media_title", "Media Title", "mdi:music-note"},
+		{"media_artist", "Media Artist", "mdi:account-music"},
+		{"media_album", "Media Album", "mdi:album"},
+		{"media_source", "Media Source", "mdi:application"},
+	} {
+		mediaConfig := map[string]interface{}{
+			"name":                  m.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + m.id,
+			"state_topic":           prefix + "/status/" + m.id,
+			"icon":                  m.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+m.id, mediaConfig)
+	}
+
+	// Image for album art
+	publishArtworkConfig(client, media.artworkContentType())
+
+	// Buttons for media transport
+	for _, b := range []struct {
+		id      string
+		name    string
+		payload string
+		icon    string
+	}{
+		{"media_playpause", "Play/Pause", "playpause", "mdi:play-pause"},
+		{"media_next", "Next Track", "next", "mdi:skip-next"},
+		{"media_previous", "Previous Track", "previous", "mdi:skip-previous"},
+	} {
+		mediaButtonConfig := map[string]interface{}{
+			"name":                  b.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + b.id,
+			"command_topic":         prefix + "/command/media",
+			"payload_press":         b.payload,
+			"icon":                  b.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "button", hostname+"_"+b.id, mediaButtonConfig)
+	}
+
 	// Button for sleep
 	sleepConfig := map[string]interface{}{
 		"name":                  "Sleep",
@@ -427,6 +995,8 @@ func publishDiscoveryMessages(client mqtt.Client) {
 		"unique_id":             "mac2mqtt_" + hostname + "_wifi_signal_strength",
 		"state_topic":           prefix + "/status/wifi_signal_strength",
 		"unit_of_measurement":   "dBm",
+		"device_class":          "signal_strength",
+		"state_class":           "measurement",
 		"icon":                  "mdi:wifi-strength-2",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
@@ -448,100 +1018,451 @@ func publishDiscoveryMessages(client mqtt.Client) {
 	}
 	publishConfig(client, "sensor", hostname+"_wifi_ip", wifiIPConfig)
 
-	// Sensor for System Uptime
-	uptimeConfig := map[string]interface{}{
-		"name":                  "Last Boot",
-		"unique_id":             "mac2mqtt_" + hostname + "_uptime",
-		"state_topic":           prefix + "/status/uptime",
-		"device_class":          "timestamp",
-		"icon":                  "mdi:clock-outline",
+	// Sensors for the primary network connection
+	for _, e := range networkInfoEntities {
+		networkInfoConfig := map[string]interface{}{
+			"name":                  e.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + e.id,
+			"state_topic":           prefix + "/status/" + e.id,
+			"json_attributes_topic": prefix + "/status/network_info",
+			"icon":                  e.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+e.id, networkInfoConfig)
+	}
+
+	// Binary sensor for any VPN connected
+	vpnConnectedConfig := map[string]interface{}{
+		"name":                  "VPN",
+		"unique_id":             "mac2mqtt_" + hostname + "_vpn_connected",
+		"state_topic":           prefix + "/status/vpn_connected",
+		"json_attributes_topic": prefix + "/status/vpn_attributes",
+		"payload_on":            "true",
+		"payload_off":           "false",
+		"device_class":          "connectivity",
+		"icon":                  "mdi:vpn",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_uptime", uptimeConfig)
+	publishConfig(client, "binary_sensor", hostname+"_vpn_connected", vpnConnectedConfig)
+
+	// Binary sensors for camera and microphone use by any application
+	mediaEntities := []struct {
+		id   string
+		name string
+		icon string
+	}{
+		{"camera_in_use", "Camera In Use", "mdi:webcam"},
+		{"microphone_in_use", "Microphone In Use", "mdi:microphone"},
+	}
+	for _, e := range mediaEntities {
+		mediaConfig := map[string]interface{}{
+			"name":                  e.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + e.id,
+			"state_topic":           prefix + "/status/" + e.id,
+			"payload_on":            "true",
+			"payload_off":           "false",
+			"icon":                  e.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "binary_sensor", hostname+"_"+e.id, mediaConfig)
+	}
 
-	// Sensor for Network Upload Rate
-	networkUploadConfig := map[string]interface{}{
-		"name":                  "Network Upload",
-		"unique_id":             "mac2mqtt_" + hostname + "_network_upload_rate",
-		"state_topic":           prefix + "/status/network_upload_rate",
-		"unit_of_measurement":   "KB/s",
-		"icon":                  "mdi:upload",
-		"state_class":           "measurement",
+	// Binary sensor for a video call in progress
+	callConfig := map[string]interface{}{
+		"name":                  "In Call",
+		"unique_id":             "mac2mqtt_" + hostname + "_in_call",
+		"state_topic":           prefix + "/status/in_call",
+		"json_attributes_topic": prefix + "/status/in_call_attributes",
+		"payload_on":            "true",
+		"payload_off":           "false",
+		"icon":                  "mdi:video-account",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "binary_sensor", hostname+"_in_call", callConfig)
+
+	networkEventConfig := map[string]interface{}{
+		"name":                  "Network Event",
+		"unique_id":             "mac2mqtt_" + hostname + "_network_event",
+		"state_topic":           prefix + "/status/network_event",
+		"event_types":           []string{"connected", "disconnected", "changed"},
+		"icon":                  "mdi:lan-pending",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_network_upload_rate", networkUploadConfig)
+	publishConfig(client, "event", hostname+"_network_event", networkEventConfig)
+
+	// Switches for the Wi-Fi and Bluetooth radios
+	for _, r := range []struct {
+		id     string
+		name   string
+		icon   string
+		helper string // Optional tool needed to switch the radio
+	}{
+		{"wifi_power", "Wi-Fi", "mdi:wifi", ""},
+		{"bluetooth_power", "Bluetooth", "mdi:bluetooth", "blueutil"},
+	} {
+		if r.helper != "" && findHelper(r.helper) == "" {
+			// Without the helper the radio can't be switched, so only its state is shown
+			removeConfig(client, "switch", hostname+"_"+r.id)
+
+			radioStateConfig := map[string]interface{}{
+				"name":                  r.name,
+				"unique_id":             "mac2mqtt_" + hostname + "_" + r.id,
+				"state_topic":           prefix + "/status/" + r.id,
+				"payload_on":            "true",
+				"payload_off":           "false",
+				"icon":                  r.icon,
+				"availability_topic":    prefix + "/status/alive",
+				"payload_available":     "true",
+				"payload_not_available": "false",
+				"device":                device,
+			}
+			publishConfig(client, "binary_sensor", hostname+"_"+r.id, radioStateConfig)
+			continue
+		}
+		removeConfig(client, "binary_sensor", hostname+"_"+r.id)
+
+		radioConfig := map[string]interface{}{
+			"name":                  r.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + r.id,
+			"state_topic":           prefix + "/status/" + r.id,
+			"command_topic":         prefix + "/command/" + r.id,
+			"payload_on":            "true",
+			"payload_off":           "false",
+			"icon":                  r.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "switch", hostname+"_"+r.id, radioConfig)
+	}
 
-	// Sensor for Network Download Rate
-	networkDownloadConfig := map[string]interface{}{
-		"name":                  "Network Download",
-		"unique_id":             "mac2mqtt_" + hostname + "_network_download_rate",
-		"state_topic":           prefix + "/status/network_download_rate",
-		"unit_of_measurement":   "KB/s",
-		"icon":                  "mdi:download",
+	// Sensor for connected Bluetooth devices
+	bluetoothCountConfig := map[string]interface{}{
+		"name":                  "Bluetooth Connected Devices",
+		"unique_id":             "mac2mqtt_" + hostname + "_bluetooth_connected_count",
+		"state_topic":           prefix + "/status/bluetooth_connected_count",
+		"json_attributes_topic": prefix + "/status/bluetooth_devices",
 		"state_class":           "measurement",
+		"icon":                  "mdi:bluetooth-connect",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_network_download_rate", networkDownloadConfig)
+	publishConfig(client, "sensor", hostname+"_bluetooth_connected_count", bluetoothCountConfig)
 
-	// Sensor for Battery Temperature
-	battTempConfig := map[string]interface{}{
-		"name":                  "Battery Temperature",
-		"unique_id":             "mac2mqtt_" + hostname + "_battery_temperature",
-		"state_topic":           prefix + "/status/battery_temperature",
-		"unit_of_measurement":   "°C",
-		"device_class":          "temperature",
-		"icon":                  "mdi:thermometer",
+	// Sensors for Wi-Fi signal quality, derived from the signal strength
+	wifiQualityConfig := map[string]interface{}{
+		"name":                  "Wi-Fi Signal Quality",
+		"unique_id":             "mac2mqtt_" + hostname + "_wifi_signal_quality",
+		"state_topic":           prefix + "/status/wifi_signal_quality",
+		"unit_of_measurement":   "%",
+		"state_class":           "measurement",
+		"icon":                  "mdi:wifi-strength-3",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_battery_temperature", battTempConfig)
-
-	// Sensor for CPU Temperature
-	cpuTempConfig := map[string]interface{}{
-		"name":                  "CPU Temperature",
-		"unique_id":             "mac2mqtt_" + hostname + "_cpu_temperature",
-		"state_topic":           prefix + "/status/cpu_temperature",
-		"unit_of_measurement":   "°C",
-		"device_class":          "temperature",
-		"icon":                  "mdi:thermometer",
+	publishConfig(client, "sensor", hostname+"_wifi_signal_quality", wifiQualityConfig)
+
+	wifiConnectionQualityConfig := map[string]interface{}{
+		"name":                  "Wi-Fi Connection Quality",
+		"unique_id":             "mac2mqtt_" + hostname + "_wifi_connection_quality",
+		"state_topic":           prefix + "/status/wifi_connection_quality",
+		"device_class":          "enum",
+		"options":               []string{"excellent", "good", "fair", "poor"},
+		"icon":                  "mdi:wifi-star",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_cpu_temperature", cpuTempConfig)
-
-	// Sensor for Fan Speed
-	fanSpeedConfig := map[string]interface{}{
-		"name":                  "Fan Speed",
-		"unique_id":             "mac2mqtt_" + hostname + "_fan_speed",
-		"state_topic":           prefix + "/status/fan_speed",
-		"unit_of_measurement":   "rpm",
-		"icon":                  "mdi:fan",
-		"state_class":           "measurement",
+	publishConfig(client, "sensor", hostname+"_wifi_connection_quality", wifiConnectionQualityConfig)
+
+	// Event for Wi-Fi roaming and disconnects
+	wifiEventConfig := map[string]interface{}{
+		"name":                  "Wi-Fi Event",
+		"unique_id":             "mac2mqtt_" + hostname + "_wifi_event",
+		"state_topic":           prefix + "/status/wifi_event",
+		"event_types":           []string{"connected", "disconnected", "roamed"},
+		"icon":                  "mdi:wifi-sync",
 		"availability_topic":    prefix + "/status/alive",
 		"payload_available":     "true",
 		"payload_not_available": "false",
 		"device":                device,
 	}
-	publishConfig(client, "sensor", hostname+"_fan_speed", fanSpeedConfig)
-
-	log.Println("Published Home Assistant MQTT discovery messages")
-}
+	publishConfig(client, "event", hostname+"_wifi_event", wifiEventConfig)
+
+	// Sensors for Wi-Fi link details
+	for _, w := range []struct {
+		id          string
+		name        string
+		unit        string
+		deviceClass string
+		icon        string
+	}{
+		{"wifi_bssid", "Wi-Fi BSSID", "", "", "mdi:access-point"},
+		{"wifi_noise", "Wi-Fi Noise", "dBm", "signal_strength", "mdi:wifi-strength-alert-outline"},
+		{"wifi_snr", "Wi-Fi SNR", "dB", "", "mdi:wifi-check"},
+		{"wifi_channel", "Wi-Fi Channel", "", "", "mdi:wifi-settings"},
+		{"wifi_band", "Wi-Fi Band", "", "", "mdi:wifi-settings"},
+		{"wifi_phy_mode", "Wi-Fi PHY Mode", "", "", "mdi:wifi-cog"},
+		{"wifi_tx_rate", "Wi-Fi Transmit Rate", "Mbit/s", "data_rate", "mdi:speedometer"},
+	} {
+		wifiConfig := map[string]interface{}{
+			"name":                  w.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + w.id,
+			"state_topic":           prefix + "/status/" + w.id,
+			"icon":                  w.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		if w.unit != "" {
+			wifiConfig["unit_of_measurement"] = w.unit
+			wifiConfig["state_class"] = "measurement"
+		}
+		if w.deviceClass != "" {
+			wifiConfig["device_class"] = w.deviceClass
+		}
+		publishConfig(client, "sensor", hostname+"_"+w.id, wifiConfig)
+	}
 
-func publishConfig(client mqtt.Client, component, objectId string, config map[string]interface{}) {
-	topic := fmt.Sprintf("homeassistant/%s/mac2mqtt_%s/%s/config", component, hostname, objectId)
+	// Diagnostic sensors for the MQTT broker connection
+	for _, e := range brokerEntities {
+		brokerConfig := map[string]interface{}{
+			"name":                  e.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + e.id,
+			"state_topic":           prefix + "/status/" + e.id,
+			"entity_category":       "diagnostic",
+			"icon":                  e.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		for key, value := range e.extras {
+			brokerConfig[key] = value
+		}
+		if e.disconnects {
+			brokerConfig["json_attributes_topic"] = prefix + "/status/broker_disconnects"
+		}
+		publishConfig(client, "sensor", hostname+"_"+e.id, brokerConfig)
+	}
+
+	// Sensor for System Uptime
+	uptimeConfig := map[string]interface{}{
+		"name":                  "Last Boot",
+		"unique_id":             "mac2mqtt_" + hostname + "_uptime",
+		"state_topic":           prefix + "/status/uptime",
+		"device_class":          "timestamp",
+		"icon":                  "mdi:clock-outline",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_uptime", uptimeConfig)
+
+	// Sensors for network rates of the primary interface
+	publishNetworkRateSensors(client, "")
+
+	// Sensors for total network traffic, for Home Assistant long-term statistics
+	for _, t := range []struct {
+		id   string
+		name string
+		icon string
+	}{
+		{"network_bytes_received", "Network Total Received", "mdi:download-network"},
+		{"network_bytes_sent", "Network Total Sent", "mdi:upload-network"},
+	} {
+		trafficConfig := map[string]interface{}{
+			"name":                          t.name,
+			"unique_id":                     "mac2mqtt_" + hostname + "_" + t.id,
+			"state_topic":                   prefix + "/status/" + t.id,
+			"unit_of_measurement":           "B",
+			"device_class":                  "data_size",
+			"state_class":                   "total_increasing",
+			"suggested_unit_of_measurement": "GB",
+			"suggested_display_precision":   2,
+			"icon":                          t.icon,
+			"availability_topic":            prefix + "/status/alive",
+			"payload_available":             "true",
+			"payload_not_available":         "false",
+			"device":                        device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+t.id, trafficConfig)
+	}
+
+	// Sensors for CPU usage
+	for _, s := range []struct {
+		id   string
+		name string
+		icon string
+	}{
+		{"cpu_usage", "CPU Usage", "mdi:cpu-64-bit"},
+		{"cpu_user", "CPU User", "mdi:account"},
+		{"cpu_system", "CPU System", "mdi:cog"},
+		{"cpu_idle", "CPU Idle", "mdi:sleep"},
+	} {
+		cpuConfig := map[string]interface{}{
+			"name":                        s.name,
+			"unique_id":                   "mac2mqtt_" + hostname + "_" + s.id,
+			"state_topic":                 prefix + "/status/" + s.id,
+			"unit_of_measurement":         "%",
+			"state_class":                 "measurement",
+			"suggested_display_precision": 1,
+			"icon":                        s.icon,
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+s.id, cpuConfig)
+	}
+
+	for i := 0; i < runtime.NumCPU(); i++ {
+		objectId := fmt.Sprintf("%s_cpu_core_%d_usage", hostname, i)
+		if !cpuPerCore {
+			removeConfig(client, "sensor", objectId)
+			continue
+		}
+
+		coreConfig := map[string]interface{}{
+			"name":                        fmt.Sprintf("CPU Core %d Usage", i),
+			"unique_id":                   "mac2mqtt_" + objectId,
+			"state_topic":                 fmt.Sprintf("%s/status/cpu_core_%d_usage", prefix, i),
+			"unit_of_measurement":         "%",
+			"state_class":                 "measurement",
+			"suggested_display_precision": 1,
+			"icon":                        "mdi:cpu-64-bit",
+			"entity_category":             "diagnostic",
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		publishConfig(client, "sensor", objectId, coreConfig)
+	}
+
+	// Sensors for load averages
+	for _, period := range []string{"1", "5", "15"} {
+		loadConfig := map[string]interface{}{
+			"name":                        "Load Average (" + period + " min)",
+			"unique_id":                   "mac2mqtt_" + hostname + "_load_" + period,
+			"state_topic":                 prefix + "/status/load_" + period,
+			"state_class":                 "measurement",
+			"suggested_display_precision": 2,
+			"icon":                        "mdi:gauge",
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		publishConfig(client, "sensor", hostname+"_load_"+period, loadConfig)
+	}
+
+	// Sensors for memory and swap
+	for _, e := range memoryEntities {
+		memoryConfig := map[string]interface{}{
+			"name":                          e.name,
+			"unique_id":                     "mac2mqtt_" + hostname + "_" + e.id,
+			"state_topic":                   prefix + "/status/" + e.id,
+			"unit_of_measurement":           "B",
+			"device_class":                  "data_size",
+			"state_class":                   "measurement",
+			"suggested_unit_of_measurement": "GiB",
+			"suggested_display_precision":   2,
+			"icon":                          e.icon,
+			"availability_topic":            prefix + "/status/alive",
+			"payload_available":             "true",
+			"payload_not_available":         "false",
+			"device":                        device,
+		}
+		publishConfig(client, "sensor", hostname+"_"+e.id, memoryConfig)
+	}
+
+	memoryPressureConfig := map[string]interface{}{
+		"name":                  "Memory Pressure",
+		"unique_id":             "mac2mqtt_" + hostname + "_memory_pressure",
+		"state_topic":           prefix + "/status/memory_pressure",
+		"device_class":          "enum",
+		"options":               []string{"normal", "warn", "critical"},
+		"icon":                  "mdi:gauge-full",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_memory_pressure", memoryPressureConfig)
+
+	memoryFreePercentConfig := map[string]interface{}{
+		"name":                  "Memory Free Percentage",
+		"unique_id":             "mac2mqtt_" + hostname + "_memory_free_percent",
+		"state_topic":           prefix + "/status/memory_free_percent",
+		"unit_of_measurement":   "%",
+		"state_class":           "measurement",
+		"icon":                  "mdi:memory",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_memory_free_percent", memoryFreePercentConfig)
+
+	// Sensor for CPU Temperature
+	cpuTempConfig := map[string]interface{}{
+		"name":                  "CPU Temperature",
+		"unique_id":             "mac2mqtt_" + hostname + "_cpu_temperature",
+		"state_topic":           prefix + "/status/cpu_temperature",
+		"unit_of_measurement":   "°C",
+		"device_class":          "temperature",
+		"icon":                  "mdi:thermometer",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_cpu_temperature", cpuTempConfig)
+
+	// Sensor for Fan Speed
+	fanSpeedConfig := map[string]interface{}{
+		"name":                  "Fan Speed",
+		"unique_id":             "mac2mqtt_" + hostname + "_fan_speed",
+		"state_topic":           prefix + "/status/fan_speed",
+		"unit_of_measurement":   "rpm",
+		"icon":                  "mdi:fan",
+		"state_class":           "measurement",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_fan_speed", fanSpeedConfig)
+
+	log.Println("Published Home Assistant MQTT discovery messages")
+}
+
+func publishConfig(client mqtt.Client, component, objectId string, config map[string]interface{}) {
+	topic := fmt.Sprintf("homeassistant/%s/mac2mqtt_%s/%s/config", component, hostname, objectId)
 	payload, err := json.Marshal(config)
 	if err != nil {
 		log.Printf("Error marshaling config for %s: %v", objectId, err)
@@ -553,10 +1474,228 @@ func publishConfig(client mqtt.Client, component, objectId string, config map[st
 	if token.Error() != nil {
 		log.Printf("Error publishing discovery for %s: %v", objectId, token.Error())
 	}
+
+	sensors.record(component, objectId, config)
+}
+
+// publishEvent publishes a Home Assistant event entity payload: the event type
+// merged with the JSON fields of details
+func publishEvent(client mqtt.Client, topic, eventType string, details interface{}) {
+	event := map[string]interface{}{}
+	if details != nil {
+		if data, err := json.Marshal(details); err == nil {
+			json.Unmarshal(data, &event)
+		}
+	}
+	event["event_type"] = eventType
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling event for %s: %v", topic, err)
+		return
+	}
+
+	token := publishMQTT(client, topic, 0, false, payload)
+	token.Wait()
+}
+
+// removeConfig retires a discovered entity by publishing an empty retained config
+func removeConfig(client mqtt.Client, component, objectId string) {
+	topic := fmt.Sprintf("homeassistant/%s/mac2mqtt_%s/%s/config", component, hostname, objectId)
+
+	token := publishMQTT(client, topic, 0, true, "")
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Error removing discovery for %s: %v", objectId, token.Error())
+	}
+
+	sensors.forget(objectId)
+}
+
+// maxRecentDisconnects is how many disconnects are kept in the attributes
+const maxRecentDisconnects = 10
+
+// brokerDisconnect is one lost connection
+type brokerDisconnect struct {
+	Time   string `json:"time"`
+	Reason string `json:"reason"`
+}
+
+// brokerHealth tracks the MQTT connection for the diagnostic entities
+type brokerHealth struct {
+	url               string
+	connects          int
+	disconnects       int
+	lastConnected     time.Time
+	reasons           map[string]int
+	recentDisconnects []brokerDisconnect
+	latency           time.Duration // Round trip of the last ping, 0 until one came back
+	pingSent          time.Time     // When the last ping was sent
+	pingAnswered      bool          // Whether the last ping came back
+	mu                sync.Mutex
+}
+
+// brokerPingTimeout is how long a ping may take before the latency is shown as unknown
+const brokerPingTimeout = 5 * time.Second
+
+// pendingPublishes counts publishes that have not completed yet, the outbound queue depth
+var pendingPublishes atomic.Int64
+
+// countedToken takes its publish off pendingPublishes once it completed. Every caller
+// waits for its token, so completion is seen in Wait without a goroutine per publish.
+type countedToken struct {
+	mqtt.Token
+	once sync.Once
+}
+
+func (t *countedToken) completed() {
+	t.once.Do(func() { pendingPublishes.Add(-1) })
+}
+
+func (t *countedToken) Wait() bool {
+	ok := t.Token.Wait()
+	t.completed()
+	return ok
+}
+
+func (t *countedToken) WaitTimeout(d time.Duration) bool {
+	ok := t.Token.WaitTimeout(d)
+	if ok {
+		t.completed()
+	}
+	return ok
+}
+
+var broker = &brokerHealth{reasons: make(map[string]int)}
+
+func (b *brokerHealth) connected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.connects++
+	b.lastConnected = time.Now()
+}
+
+func (b *brokerHealth) lost(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	reason := "unknown"
+	if err != nil {
+		reason = err.Error()
+	}
+
+	b.disconnects++
+	b.reasons[reason]++
+	b.recentDisconnects = append(b.recentDisconnects, brokerDisconnect{
+		Time:   time.Now().Format(time.RFC3339),
+		Reason: reason,
+	})
+	if len(b.recentDisconnects) > maxRecentDisconnects {
+		b.recentDisconnects = b.recentDisconnects[len(b.recentDisconnects)-maxRecentDisconnects:]
+	}
+}
+
+func getPingTopic() string {
+	return getTopicPrefix() + "/diagnostics/ping"
+}
+
+// sendPing publishes the current time to the ping topic; handlePing measures
+// the round trip when the broker delivers it back
+func sendPing(client mqtt.Client) {
+	now := time.Now()
+
+	broker.mu.Lock()
+	broker.pingSent = now
+	broker.pingAnswered = false
+	broker.mu.Unlock()
+
+	token := publishMQTT(client, getPingTopic(), 0, false, strconv.FormatInt(now.UnixNano(), 10))
+	token.Wait()
+}
+
+// handlePing only records the latency: publishing from a message handler can block the client
+func handlePing(client mqtt.Client, msg mqtt.Message) {
+	sent, err := strconv.ParseInt(string(msg.Payload()), 10, 64)
+	if err != nil {
+		return
+	}
+
+	broker.mu.Lock()
+	broker.latency = time.Since(time.Unix(0, sent))
+	if sent == broker.pingSent.UnixNano() {
+		broker.pingAnswered = true
+	}
+	broker.mu.Unlock()
+}
+
+// updateBrokerHealth publishes the connection diagnostics and sends the next ping
+func updateBrokerHealth(client mqtt.Client) {
+	prefix := getTopicPrefix()
+
+	broker.mu.Lock()
+	values := map[string]string{
+		"broker_url":                    broker.url,
+		"broker_connect_count":          strconv.Itoa(broker.connects),
+		"broker_disconnect_count":       strconv.Itoa(broker.disconnects),
+		"broker_last_connected":         broker.lastConnected.Format(time.RFC3339),
+		"broker_last_disconnect_reason": "None",
+		"broker_latency":                "None",
+		"broker_queue_depth":            strconv.FormatInt(pendingPublishes.Load(), 10),
+	}
+	if n := len(broker.recentDisconnects); n > 0 {
+		values["broker_last_disconnect_reason"] = broker.recentDisconnects[n-1].Reason
+	}
+	if !broker.pingSent.IsZero() && !broker.pingAnswered && time.Since(broker.pingSent) > brokerPingTimeout {
+		// The last ping never came back, an old latency would hide the problem
+		broker.latency = 0
+	}
+	if broker.latency > 0 {
+		values["broker_latency"] = strconv.FormatFloat(float64(broker.latency.Microseconds())/1000.0, 'f', 1, 64)
+	}
+	attributes, _ := json.Marshal(map[string]interface{}{
+		"reasons": broker.reasons,
+		"recent":  broker.recentDisconnects,
+	})
+	broker.mu.Unlock()
+
+	token := publishMQTT(client, prefix+"/status/broker_disconnects", 0, false, string(attributes))
+	token.Wait()
+
+	for _, e := range brokerEntities {
+		token := publishMQTT(client, prefix+"/status/"+e.id, 0, false, values[e.id])
+		token.Wait()
+	}
+
+	sendPing(client)
+}
+
+// brokerEntities are the diagnostic sensors for the MQTT connection.
+// Those with disconnects set show the disconnect history as attributes.
+var brokerEntities = []struct {
+	id          string
+	name        string
+	icon        string
+	disconnects bool
+	extras      map[string]interface{}
+}{
+	{"broker_url", "Broker URL", "mdi:server-network", false, nil},
+	{"broker_connect_count", "Broker Connects", "mdi:connection", false, map[string]interface{}{"state_class": "total_increasing"}},
+	{"broker_disconnect_count", "Broker Disconnects", "mdi:lan-disconnect", true, map[string]interface{}{"state_class": "total_increasing"}},
+	{"broker_last_disconnect_reason", "Broker Last Disconnect Reason", "mdi:alert-circle-outline", true, nil},
+	{"broker_last_connected", "Broker Last Connected", "mdi:clock-check-outline", false, map[string]interface{}{"device_class": "timestamp"}},
+	{"broker_latency", "Broker Latency", "mdi:timer-outline", false, map[string]interface{}{
+		"unit_of_measurement":         "ms",
+		"device_class":                "duration",
+		"state_class":                 "measurement",
+		"suggested_display_precision": 1,
+	}},
+	{"broker_queue_depth", "Broker Queue Depth", "mdi:tray-full", false, map[string]interface{}{"state_class": "measurement"}},
 }
 
 var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 	log.Println("Connected to MQTT")
+	broker.connected()
 
 	token := publishMQTT(client, getTopicPrefix()+"/status/alive", 0, true, "true")
 	token.Wait()
@@ -565,38 +1704,63 @@ var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 
 	// Publish Home Assistant discovery messages
 	publishDiscoveryMessages(client)
+	publishCapabilities(client)
 
 	// Publish initial metrics
-	updateVolume(client)
-	updateMute(client)
+	updateVolumeSettings(client)
+	updateAudioDevices(client)
+	updateBrightness(client)
+	updateDisplays(client)
 	updateBattery(client)
+	updatePowerSource(client)
+	updatePower(client)
 	updateActiveApp(client)
-	updateWiFiSSID(client)
-	updateWiFiSignalStrength(client)
-	updateWiFiIPAddress(client)
+	updateNowPlaying(client)
+	updateWiFi(client)
+	updateRadios(client)
+	updateBluetooth(client)
+	updateNetworkInfo(client)
+	updateVPN(client)
+	updateMediaUsage(client)
+	requestCallUpdate()
 	updateSystemUptime(client)
 	updateNetworkActivity(client)
+	updateCPU(client)
+	updateLoadAverage(client)
+	updateMemory(client)
+	updateDisks(client)
 	updateTemperatures(client)
 
 	listen(client, getTopicPrefix()+"/command/#")
+
+	token = client.Subscribe(getPingTopic(), 0, handlePing)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Token error: %s\n", token.Error())
+	}
+	updateBrokerHealth(client)
 }
 
 var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err error) {
 	log.Printf("Disconnected from MQTT: %v", err)
+	broker.lost(err)
 }
 
 func getMQTTClient(ip, port, user, password string) mqtt.Client {
 	// In dry-run mode, skip actual MQTT connection
 	if dryRunMode {
 		log.Println("Dry-run mode: Simulating MQTT connection")
+		broker.url = "dry-run"
 		client := &dummyClient{}
 		// Manually trigger the connect handler to simulate connection
 		connectHandler(client)
 		return client
 	}
 
+	broker.url = fmt.Sprintf("tcp://%s:%s", ip, port)
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%s", ip, port))
+	opts.AddBroker(broker.url)
 	opts.SetUsername(user)
 	opts.SetPassword(password)
 	opts.OnConnect = connectHandler
@@ -684,8 +1848,8 @@ func publishMQTT(client mqtt.Client, topic string, qos byte, retained bool, payl
 		return &dummyToken{}
 	}
 
-	token := client.Publish(topic, qos, retained, payload)
-	return token
+	pendingPublishes.Add(1)
+	return &countedToken{Token: client.Publish(topic, qos, retained, payload)}
 }
 
 // dummyToken is a no-op token for dry-run mode
@@ -722,646 +1886,5252 @@ func (c *dummyClient) OptionsReader() mqtt.ClientOptionsReader {
 	return mqtt.ClientOptionsReader{}
 }
 
-func listen(client mqtt.Client, topic string) {
-
-	token := client.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
+// payloadSchema describes the payload accepted by a command or published by a sensor.
+// It is included verbatim in the capabilities document.
+type payloadSchema struct {
+	Type    string          `json:"type"` // int, bool, enum, json, string, number, one_of
+	Min     *int            `json:"min,omitempty"`
+	Max     *int            `json:"max,omitempty"`
+	Values  []string        `json:"values,omitempty"`
+	Pattern string          `json:"pattern,omitempty"`
+	OneOf   []payloadSchema `json:"one_of,omitempty"`
+
+	valuesFunc func() []string // Enum values that change at runtime
+	pattern    *regexp.Regexp  // Pattern compiled once when the schema is built
+}
 
-		if msg.Topic() == getTopicPrefix()+"/command/volume" {
+func intSchema(min, max int) payloadSchema {
+	return payloadSchema{Type: "int", Min: &min, Max: &max}
+}
 
-			i, err := strconv.Atoi(string(msg.Payload()))
-			if err == nil && i >= 0 && i <= 100 {
+func boolSchema() payloadSchema {
+	return payloadSchema{Type: "bool"}
+}
 
-				setVolume(i)
+func enumSchema(values ...string) payloadSchema {
+	return payloadSchema{Type: "enum", Values: values}
+}
 
-				updateVolume(client)
-				updateMute(client)
+func jsonSchema() payloadSchema {
+	return payloadSchema{Type: "json"}
+}
 
-			} else {
-				log.Println("Incorrect value")
-			}
+// dynamicEnumSchema is an enum whose values are looked up each time they are needed
+func dynamicEnumSchema(values func() []string) payloadSchema {
+	return payloadSchema{Type: "enum", valuesFunc: values}
+}
 
+// resolved returns a copy of the schema with dynamic enum values filled in
+func (s payloadSchema) resolved() payloadSchema {
+	if s.valuesFunc != nil {
+		s.Values = s.valuesFunc()
+	}
+	if s.OneOf != nil {
+		options := make([]payloadSchema, len(s.OneOf))
+		for i, option := range s.OneOf {
+			options[i] = option.resolved()
 		}
+		s.OneOf = options
+	}
+	return s
+}
 
-		if msg.Topic() == getTopicPrefix()+"/command/mute" {
-
-			b, err := strconv.ParseBool(string(msg.Payload()))
-			if err == nil {
-				setMute(b)
+func patternSchema(pattern string) payloadSchema {
+	return payloadSchema{Type: "string", Pattern: pattern, pattern: regexp.MustCompile(pattern)}
+}
 
-				updateVolume(client)
-				updateMute(client)
+// oneOfSchema accepts a payload matching any of the given schemas, tried in order
+func oneOfSchema(schemas ...payloadSchema) payloadSchema {
+	return payloadSchema{Type: "one_of", OneOf: schemas}
+}
 
-			} else {
-				log.Println("Incorrect value")
-			}
+// parse validates the payload against the schema and returns the typed value:
+// int for int, bool for bool, string for enum and string, json.RawMessage for json.
+// For one_of the value of the first matching schema is returned.
+func (s payloadSchema) parse(payload string) (interface{}, error) {
+	if s.valuesFunc != nil {
+		s.Values = s.valuesFunc()
+	}
 
+	switch s.Type {
+	case "int":
+		i, err := strconv.Atoi(strings.TrimSpace(payload))
+		if err != nil {
+			return nil, fmt.Errorf("not an integer: %q", payload)
 		}
-
-		if msg.Topic() == getTopicPrefix()+"/command/sleep" {
-
-			if string(msg.Payload()) == "sleep" {
-				commandSleep()
-			}
-
+		if s.Min != nil && i < *s.Min {
+			return nil, fmt.Errorf("%d is below minimum %d", i, *s.Min)
 		}
-
-		if msg.Topic() == getTopicPrefix()+"/command/displaysleep" {
-
-			if string(msg.Payload()) == "displaysleep" {
-				commandDisplaySleep()
-			}
-
+		if s.Max != nil && i > *s.Max {
+			return nil, fmt.Errorf("%d is above maximum %d", i, *s.Max)
 		}
+		return i, nil
 
-		if msg.Topic() == getTopicPrefix()+"/command/shutdown" {
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(payload))
+		if err != nil {
+			return nil, fmt.Errorf("not a boolean: %q", payload)
+		}
+		return b, nil
 
-			if string(msg.Payload()) == "shutdown" {
-				commandShutdown()
+	case "enum":
+		for _, v := range s.Values {
+			if payload == v {
+				return v, nil
 			}
+		}
+		return nil, fmt.Errorf("%q is not one of %v", payload, s.Values)
 
+	case "json":
+		if !json.Valid([]byte(payload)) {
+			return nil, fmt.Errorf("not valid JSON: %q", payload)
 		}
+		return json.RawMessage(payload), nil
 
-		if msg.Topic() == getTopicPrefix()+"/command/reboot" {
+	case "string":
+		if s.pattern != nil && !s.pattern.MatchString(payload) {
+			return nil, fmt.Errorf("%q does not match %s", payload, s.Pattern)
+		}
+		return payload, nil
 
-			if string(msg.Payload()) == "reboot" {
-				commandReboot()
+	case "one_of":
+		for _, option := range s.OneOf {
+			if value, err := option.parse(payload); err == nil {
+				return value, nil
 			}
-
 		}
-
-	})
-
-	token.Wait()
-	if token.Error() != nil {
-		log.Printf("Token error: %s\n", token.Error())
+		return nil, fmt.Errorf("%q does not match any accepted format", payload)
 	}
-}
 
-func updateVolume(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/volume", 0, false, strconv.Itoa(getCurrentVolume()))
-	token.Wait()
+	return nil, fmt.Errorf("unknown schema type %q", s.Type)
 }
 
-func updateMute(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/mute", 0, false, strconv.FormatBool(getMuteStatus()))
-	token.Wait()
+// command is a single MQTT command handled under <prefix>/command/<name>
+type command struct {
+	name        string
+	description string
+	schema      payloadSchema
+	handler     func(client mqtt.Client, value interface{})
 }
 
-func getBatteryChargePercent() string {
-
-	output := getCommandOutput("/usr/bin/pmset", "-g", "batt")
+// commandRouter dispatches incoming command messages to registered commands
+type commandRouter struct {
+	commands []*command
+	byName   map[string]*command
+	mu       sync.RWMutex
+}
 
-	// $ /usr/bin/pmset -g batt
-	// Now drawing from 'Battery Power'
-	//  -InternalBattery-0 (id=4653155)        100%; discharging; 20:00 remaining present: true
+var router = &commandRouter{byName: make(map[string]*command)}
 
-	r := regexp.MustCompile(`(\d+)%`)
-	percent := r.FindStringSubmatch(output)[1]
+func (r *commandRouter) register(c *command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return percent
+	if _, exists := r.byName[c.name]; exists {
+		log.Printf("Warning: command %s registered twice, ignoring", c.name)
+		return
+	}
+	r.commands = append(r.commands, c)
+	r.byName[c.name] = c
 }
 
-func updateBattery(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/battery", 0, false, getBatteryChargePercent())
-	token.Wait()
-}
+func (r *commandRouter) lookup(topic string) *command {
+	name := strings.TrimPrefix(topic, getTopicPrefix()+"/command/")
+	if name == topic {
+		return nil
+	}
 
-func getSystemUptime() string {
-	output := getCommandOutput("/usr/sbin/sysctl", "-n", "kern.boottime")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byName[name]
+}
 
-	// Parse boot time: { sec = 1766859018, usec = 483520 } Sat Dec 27 19:10:18 2025
-	r := regexp.MustCompile(`sec = (\d+)`)
-	matches := r.FindStringSubmatch(output)
-	if len(matches) < 2 {
-		return ""
+func (r *commandRouter) handle(client mqtt.Client, msg mqtt.Message) {
+	c := r.lookup(msg.Topic())
+	if c == nil {
+		if debugMode {
+			log.Printf("No command registered for topic %s", msg.Topic())
+		}
+		return
 	}
 
-	bootTimeSec, err := strconv.ParseInt(matches[1], 10, 64)
+	value, err := c.schema.parse(string(msg.Payload()))
 	if err != nil {
-		return ""
+		log.Printf("Incorrect value for command %s: %v", c.name, err)
+		return
 	}
 
-	// Return ISO 8601 timestamp for Home Assistant timestamp sensor
-	bootTime := time.Unix(bootTimeSec, 0)
-	return bootTime.Format(time.RFC3339)
+	c.handler(client, value)
 }
 
-func updateSystemUptime(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/uptime", 0, false, getSystemUptime())
-	token.Wait()
-}
+// registerCommands registers every command supported by mac2mqtt
+func registerCommands() {
+	router.register(&command{
+		name:        "volume",
+		description: "Set output volume: absolute 0-100, relative +N/-N, up/down, or JSON with fade duration",
+		schema:      volumeSchema,
+		handler:     handleVolumeCommand,
+	})
 
-func getActiveApp() string {
-	output := getCommandOutput("/usr/bin/osascript", "-e", "tell application \"System Events\" to get name of first application process whose frontmost is true")
-	return output
-}
+	router.register(&command{
+		name:        "input_volume",
+		description: "Set microphone input volume",
+		schema:      intSchema(0, 100),
+		handler: func(client mqtt.Client, value interface{}) {
+			setInputVolume(value.(int))
 
-func updateActiveApp(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/active_app", 0, false, getActiveApp())
-	token.Wait()
-}
+			updateVolumeSettings(client)
+		},
+	})
 
-var ssidWarningOnce sync.Once
+	router.register(&command{
+		name:        "alert_volume",
+		description: "Set alert volume",
+		schema:      intSchema(0, 100),
+		handler: func(client mqtt.Client, value interface{}) {
+			setAlertVolume(value.(int))
 
-func getWiFiSSID() string {
-	// Try system_profiler first - works on modern macOS when Location Services is enabled
-	if ssid, _, ok := getWiFiInfoFromSystemProfiler(); ok && ssid != "" {
-		return ssid
-	}
+			updateVolumeSettings(client)
+		},
+	})
+
+	router.register(&command{
+		name:        "audio_output_device",
+		description: "Switch the default audio output device",
+		schema:      dynamicEnumSchema(audioDevices.outputNames),
+		handler: func(client mqtt.Client, value interface{}) {
+			if err := setAudioDevice("output", value.(string)); err != nil {
+				log.Printf("Failed to switch audio output device: %v", err)
+			}
+
+			updateAudioDevices(client)
+			updateVolumeSettings(client)
+		},
+	})
+
+	router.register(&command{
+		name:        "audio_input_device",
+		description: "Switch the default audio input device",
+		schema:      dynamicEnumSchema(audioDevices.inputNames),
+		handler: func(client mqtt.Client, value interface{}) {
+			if err := setAudioDevice("input", value.(string)); err != nil {
+				log.Printf("Failed to switch audio input device: %v", err)
+			}
+
+			updateAudioDevices(client)
+			updateVolumeSettings(client)
+		},
+	})
+
+	router.register(&command{
+		name:        "mute",
+		description: "Mute or unmute output audio",
+		schema:      boolSchema(),
+		handler: func(client mqtt.Client, value interface{}) {
+			setMute(value.(bool))
+
+			updateVolumeSettings(client)
+		},
+	})
+
+	router.register(&command{
+		name:        "wifi_power",
+		description: "Turn the Wi-Fi radio on or off",
+		schema:      boolSchema(),
+		handler: func(client mqtt.Client, value interface{}) {
+			if err := setWiFiPower(value.(bool)); err != nil {
+				log.Printf("Failed to set Wi-Fi power: %v", err)
+			}
+
+			updateRadios(client)
+		},
+	})
+
+	// Bluetooth can only be switched with blueutil, which is looked up once at start
+	if findHelper("blueutil") != "" {
+		router.register(&command{
+			name:        "bluetooth_power",
+			description: "Turn Bluetooth on or off",
+			schema:      boolSchema(),
+			handler: func(client mqtt.Client, value interface{}) {
+				if err := setBluetoothPower(value.(bool)); err != nil {
+					log.Printf("Failed to set Bluetooth power: %v", err)
+				}
+
+				updateRadios(client)
+			},
+		})
+	}
+
+	router.register(&command{
+		name:        "vpn",
+		description: "Start or stop a VPN service by name or UUID: {\"service\": NAME, \"connected\": true/false}",
+		schema:      jsonSchema(),
+		handler:     handleVPNCommand,
+	})
+
+	router.register(&command{
+		name:        "brightness",
+		description: "Set display brightness: 0-100 for all displays, or {\"display\": ID, \"brightness\": 0-100}",
+		schema:      oneOfSchema(intSchema(0, 100), jsonSchema()),
+		handler:     handleBrightnessCommand,
+	})
+
+	router.register(&command{
+		name:        "media",
+		description: "Control the active media player (Music, Spotify)",
+		schema:      enumSchema("play", "pause", "playpause", "next", "previous"),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandMedia(value.(string))
+
+			updateNowPlaying(client)
+		},
+	})
+
+	router.register(&command{
+		name:        "media_seek",
+		description: "Seek the active media player to a position in seconds, or by +N/-N seconds",
+		schema:      oneOfSchema(patternSchema(`^[+-]\d+$`), intSchema(0, 86400)),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandMediaSeek(value)
+		},
+	})
+
+	router.register(&command{
+		name:        "sleep",
+		description: "Put the computer to sleep",
+		schema:      enumSchema("sleep"),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandSleep()
+		},
+	})
+
+	router.register(&command{
+		name:        "displaysleep",
+		description: "Turn off the display",
+		schema:      enumSchema("displaysleep"),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandDisplaySleep()
+		},
+	})
+
+	router.register(&command{
+		name:        "shutdown",
+		description: "Shut down the computer",
+		schema:      enumSchema("shutdown"),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandShutdown()
+		},
+	})
+
+	router.register(&command{
+		name:        "reboot",
+		description: "Reboot the computer",
+		schema:      enumSchema("reboot"),
+		handler: func(client mqtt.Client, value interface{}) {
+			commandReboot()
+		},
+	})
+}
+
+func listen(client mqtt.Client, topic string) {
+
+	token := client.Subscribe(topic, 0, router.handle)
+
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Token error: %s\n", token.Error())
+	}
+}
+
+// sensorCapability describes a state topic announced through discovery
+type sensorCapability struct {
+	Name        string        `json:"name"`
+	Component   string        `json:"component"`
+	StateTopic  string        `json:"state_topic"`
+	Unit        string        `json:"unit_of_measurement,omitempty"`
+	DeviceClass string        `json:"device_class,omitempty"`
+	Schema      payloadSchema `json:"schema"`
+}
+
+type commandCapability struct {
+	Name        string        `json:"name"`
+	Topic       string        `json:"topic"`
+	Description string        `json:"description"`
+	Schema      payloadSchema `json:"schema"`
+}
+
+type capabilities struct {
+	Hostname string              `json:"hostname"`
+	Version  string              `json:"version"`
+	Commands []commandCapability `json:"commands"`
+	Sensors  []sensorCapability  `json:"sensors"`
+}
+
+// sensorRegistry remembers every state topic published through discovery,
+// keyed by discovery object id, in the order they were first announced
+type sensorRegistry struct {
+	ids     []string
+	sensors map[string]sensorCapability
+	mu      sync.Mutex
+}
+
+var sensors = &sensorRegistry{sensors: make(map[string]sensorCapability)}
+
+func (r *sensorRegistry) record(component, objectId string, config map[string]interface{}) {
+	stateTopic, ok := config["state_topic"].(string)
+	if !ok {
+		return
+	}
+
+	s := sensorCapability{
+		Component:  component,
+		StateTopic: stateTopic,
+		Schema:     sensorSchema(component, config),
+	}
+	s.Name, _ = config["name"].(string)
+	s.Unit, _ = config["unit_of_measurement"].(string)
+	s.DeviceClass, _ = config["device_class"].(string)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.sensors[objectId]; !exists {
+		r.ids = append(r.ids, objectId)
+	}
+	r.sensors[objectId] = s
+}
+
+func (r *sensorRegistry) forget(objectId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.sensors[objectId]; !exists {
+		return
+	}
+	delete(r.sensors, objectId)
+	for i, id := range r.ids {
+		if id == objectId {
+			r.ids = append(r.ids[:i], r.ids[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *sensorRegistry) list() []sensorCapability {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]sensorCapability, 0, len(r.ids))
+	for _, id := range r.ids {
+		list = append(list, r.sensors[id])
+	}
+	return list
+}
+
+// sensorSchema derives the value schema of a state topic from its discovery config
+func sensorSchema(component string, config map[string]interface{}) payloadSchema {
+	switch component {
+	case "binary_sensor", "switch":
+		return boolSchema()
+	case "event":
+		return jsonSchema()
+	case "number":
+		s := payloadSchema{Type: "number"}
+		if min, ok := config["min"].(int); ok {
+			s.Min = &min
+		}
+		if max, ok := config["max"].(int); ok {
+			s.Max = &max
+		}
+		return s
+	}
+
+	if options, ok := config["options"].([]string); ok {
+		return enumSchema(options...)
+	}
+	if _, ok := config["unit_of_measurement"]; ok {
+		return payloadSchema{Type: "number"}
+	}
+	if _, ok := config["state_class"]; ok {
+		return payloadSchema{Type: "number"}
+	}
+	return payloadSchema{Type: "string"}
+}
+
+func getCapabilities() capabilities {
+	c := capabilities{
+		Hostname: hostname,
+		Version:  version,
+		Sensors:  sensors.list(),
+	}
+
+	router.mu.RLock()
+	for _, cmd := range router.commands {
+		c.Commands = append(c.Commands, commandCapability{
+			Name:        cmd.name,
+			Topic:       getTopicPrefix() + "/command/" + cmd.name,
+			Description: cmd.description,
+			Schema:      cmd.schema.resolved(),
+		})
+	}
+	router.mu.RUnlock()
+
+	return c
+}
+
+// publishCapabilities publishes the retained <prefix>/capabilities document
+func publishCapabilities(client mqtt.Client) {
+	payload, err := json.Marshal(getCapabilities())
+	if err != nil {
+		log.Printf("Error marshaling capabilities: %v", err)
+		return
+	}
+
+	token := publishMQTT(client, getTopicPrefix()+"/capabilities", 0, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("Error publishing capabilities: %v", token.Error())
+	}
+}
+
+// updateVolumeSettings publishes output, input and alert volume and the mute state
+// from a single `get volume settings` call
+func updateVolumeSettings(client mqtt.Client) {
+	prefix := getTopicPrefix()
+	s := getVolumeSettings()
+
+	levels := []struct {
+		topic string
+		level int
+	}{
+		{"/status/volume", s.output},
+		{"/status/input_volume", s.input},
+		{"/status/alert_volume", s.alert},
+	}
+	for _, l := range levels {
+		if l.level < 0 {
+			continue
+		}
+		token := publishMQTT(client, prefix+l.topic, 0, false, strconv.Itoa(l.level))
+		token.Wait()
+	}
+
+	token := publishMQTT(client, prefix+"/status/mute", 0, false, strconv.FormatBool(s.muted))
+	token.Wait()
+}
+
+// audioDevice is a CoreAudio device as reported by system_profiler
+type audioDevice struct {
+	name          string
+	input         bool
+	output        bool
+	defaultInput  bool
+	defaultOutput bool
+}
+
+type spAudioData struct {
+	SPAudioDataType []struct {
+		Items []struct {
+			Name          string `json:"_name"`
+			DefaultInput  string `json:"coreaudio_default_audio_input_device"`
+			DefaultOutput string `json:"coreaudio_default_audio_output_device"`
+			Inputs        int    `json:"coreaudio_device_input"`
+			Outputs       int    `json:"coreaudio_device_output"`
+		} `json:"_items"`
+	} `json:"SPAudioDataType"`
+}
+
+func getAudioDevices() ([]audioDevice, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/system_profiler", "SPAudioDataType", "-json")
+	if err != nil {
+		return nil, fmt.Errorf("system_profiler SPAudioDataType failed: %w", err)
+	}
+
+	return parseAudioDevices([]byte(output))
+}
+
+func parseAudioDevices(data []byte) ([]audioDevice, error) {
+	var sp spAudioData
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return nil, fmt.Errorf("failed to parse SPAudioDataType: %w", err)
+	}
+
+	var devices []audioDevice
+	for _, section := range sp.SPAudioDataType {
+		for _, item := range section.Items {
+			devices = append(devices, audioDevice{
+				name:          item.Name,
+				input:         item.Inputs > 0,
+				output:        item.Outputs > 0,
+				defaultInput:  item.DefaultInput == "spaudio_yes",
+				defaultOutput: item.DefaultOutput == "spaudio_yes",
+			})
+		}
+	}
+
+	return devices, nil
+}
+
+// audioDeviceState caches the device lists last announced to Home Assistant
+type audioDeviceState struct {
+	outputs   []string
+	inputs    []string
+	loaded    bool
+	published bool
+	mu        sync.Mutex
+}
+
+var audioDevices = &audioDeviceState{}
+
+func (s *audioDeviceState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
+}
+
+// load reads the device lists when no poll has succeeded yet, so the select commands
+// accept a device right after start instead of waiting for the next hardware poll
+func (s *audioDeviceState) load() {
+	s.mu.Lock()
+	loaded := s.loaded
+	s.mu.Unlock()
+	if loaded {
+		return
+	}
+
+	devices, err := getAudioDevices()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get audio devices: %v", err)
+		}
+		return
+	}
+	outputs, inputs, _, _ := splitAudioDevices(devices)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		s.outputs, s.inputs, s.loaded = outputs, inputs, true
+	}
+}
+
+func (s *audioDeviceState) outputNames() []string {
+	s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.outputs...)
+}
+
+func (s *audioDeviceState) inputNames() []string {
+	s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.inputs...)
+}
+
+// store saves the device lists and reports whether the select entities need (re)publishing
+func (s *audioDeviceState) store(outputs, inputs []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := !s.published || !equalStrings(s.outputs, outputs) || !equalStrings(s.inputs, inputs)
+	s.outputs = outputs
+	s.inputs = inputs
+	s.loaded = true
+	s.published = true
+	return changed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func publishAudioDeviceSelects(client mqtt.Client, outputs, inputs []string) {
+	prefix := getTopicPrefix()
+	device := getDeviceInfo()
+
+	selects := []struct {
+		id      string
+		name    string
+		icon    string
+		options []string
+	}{
+		{"audio_output_device", "Audio Output", "mdi:speaker", outputs},
+		{"audio_input_device", "Audio Input", "mdi:microphone", inputs},
+	}
+
+	for _, s := range selects {
+		// Home Assistant rejects a select without options
+		if len(s.options) == 0 {
+			continue
+		}
+
+		selectConfig := map[string]interface{}{
+			"name":                  s.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + s.id,
+			"state_topic":           prefix + "/status/" + s.id,
+			"command_topic":         prefix + "/command/" + s.id,
+			"options":               s.options,
+			"icon":                  s.icon,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "select", hostname+"_"+s.id, selectConfig)
+	}
+}
+
+// splitAudioDevices returns the output and input device names and the current defaults
+func splitAudioDevices(devices []audioDevice) (outputs, inputs []string, currentOutput, currentInput string) {
+	for _, d := range devices {
+		if d.output {
+			outputs = append(outputs, d.name)
+		}
+		if d.input {
+			inputs = append(inputs, d.name)
+		}
+		if d.defaultOutput {
+			currentOutput = d.name
+		}
+		if d.defaultInput {
+			currentInput = d.name
+		}
+	}
+	return outputs, inputs, currentOutput, currentInput
+}
+
+func updateAudioDevices(client mqtt.Client) {
+	devices, err := getAudioDevices()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get audio devices: %v", err)
+		}
+		return
+	}
+
+	outputs, inputs, currentOutput, currentInput := splitAudioDevices(devices)
+
+	if audioDevices.store(outputs, inputs) {
+		publishAudioDeviceSelects(client, outputs, inputs)
+		publishCapabilities(client)
+	}
+
+	prefix := getTopicPrefix()
+
+	if currentOutput != "" {
+		token := publishMQTT(client, prefix+"/status/audio_output_device", 0, false, currentOutput)
+		token.Wait()
+	}
+
+	if currentInput != "" {
+		token := publishMQTT(client, prefix+"/status/audio_input_device", 0, false, currentInput)
+		token.Wait()
+	}
+}
+
+// setAudioDevice makes the named device the default output or input device.
+// It uses SwitchAudioSource when installed and falls back to CoreAudio via Swift.
+func setAudioDevice(direction, name string) error {
+	if path := findHelper("SwitchAudioSource"); path != "" {
+		output, err := exec.Command(path, "-t", direction, "-s", name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("SwitchAudioSource failed: %v (%s)", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	return setAudioDeviceViaSwift(direction, name)
+}
+
+// setAudioDeviceViaSwift sets the default device through CoreAudio using the Swift interpreter.
+// The device name is passed through the environment so it never becomes part of the script.
+func setAudioDeviceViaSwift(direction, name string) error {
+	script := `
+import CoreAudio
+import Foundation
+
+let env = ProcessInfo.processInfo.environment
+let target = env["MAC2MQTT_AUDIO_DEVICE"] ?? ""
+let selector = env["MAC2MQTT_AUDIO_DIRECTION"] == "input" ? kAudioHardwarePropertyDefaultInputDevice : kAudioHardwarePropertyDefaultOutputDevice
+let system = AudioObjectID(kAudioObjectSystemObject)
+
+var devicesAddr = AudioObjectPropertyAddress(mSelector: kAudioHardwarePropertyDevices, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+var size: UInt32 = 0
+AudioObjectGetPropertyDataSize(system, &devicesAddr, 0, nil, &size)
+var ids = [AudioDeviceID](repeating: 0, count: Int(size) / MemoryLayout<AudioDeviceID>.size)
+AudioObjectGetPropertyData(system, &devicesAddr, 0, nil, &size, &ids)
+
+for id in ids {
+    var nameAddr = AudioObjectPropertyAddress(mSelector: kAudioObjectPropertyName, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+    var name: Unmanaged<CFString>?
+    var nameSize = UInt32(MemoryLayout<Unmanaged<CFString>?>.size)
+    if AudioObjectGetPropertyData(id, &nameAddr, 0, nil, &nameSize, &name) != noErr { continue }
+    guard let deviceName = name?.takeRetainedValue() as String?, deviceName == target else { continue }
+
+    var deviceID = id
+    var defaultAddr = AudioObjectPropertyAddress(mSelector: selector, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+    let status = AudioObjectSetPropertyData(system, &defaultAddr, 0, nil, UInt32(MemoryLayout<AudioDeviceID>.size), &deviceID)
+    print(status == noErr ? "OK" : "ERROR:\(status)")
+    exit(status == noErr ? 0 : 1)
+}
+print("NOTFOUND")
+exit(1)
+`
+	cmd := exec.Command("/usr/bin/swift", "-e", script)
+
+	env := os.Environ()
+	if cacheDir := getSwiftCacheDir(); cacheDir != "" {
+		env = append(env, "SWIFT_MODULE_CACHE_PATH="+cacheDir)
+		env = append(env, "CLANG_MODULE_CACHE_PATH="+cacheDir)
+	}
+	env = append(env, "MAC2MQTT_AUDIO_DEVICE="+name, "MAC2MQTT_AUDIO_DIRECTION="+direction)
+	cmd.Env = env
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("swift CoreAudio failed: %v (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// smartBattery is the AppleSmartBattery record from the I/O Registry
+type smartBattery struct {
+	installed         bool
+	cycleCount        int
+	designCapacity    int // mAh
+	maxCapacity       int // mAh
+	currentCapacity   int // mAh
+	isCharging        bool
+	externalConnected bool
+	fullyCharged      bool
+	timeToEmpty       int     // minutes, -1 when unknown
+	timeToFull        int     // minutes, -1 when unknown
+	voltage           int     // mV
+	amperage          int     // mA, negative while discharging
+	temperature       float64 // °C
+	systemPowerIn     int     // mW drawn from the adapter, -1 when unknown
+	adapterWatts      int
+}
+
+// parseIORegRecord parses the "Key" = value lines of `ioreg -r` output into a map.
+// Nested dictionaries and arrays are kept as their raw text.
+func parseIORegRecord(output string) map[string]string {
+	record := make(map[string]string)
+
+	r := regexp.MustCompile(`^[\s|]*"([^"]+)" = (.*)$`)
+	for _, line := range strings.Split(output, "\n") {
+		m := r.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if _, exists := record[m[1]]; !exists {
+			record[m[1]] = strings.TrimSpace(m[2])
+		}
+	}
+
+	return record
+}
+
+// ioregInt parses an integer value. ioreg prints negative numbers as unsigned
+// 64-bit values, e.g. an amperage of -1000 mA as 18446744073709550616.
+func ioregInt(record map[string]string, key string) (int, bool) {
+	u, err := strconv.ParseUint(record[key], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(int64(u)), true
+}
+
+// ioregNestedInt extracts "Key"=value from a nested dictionary value
+func ioregNestedInt(record map[string]string, dict, key string) (int, bool) {
+	m := regexp.MustCompile(`"` + regexp.QuoteMeta(key) + `"=(\d+)`).FindStringSubmatch(record[dict])
+	if m == nil {
+		return 0, false
+	}
+	u, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(int64(u)), true
+}
+
+// getSmartBattery reads the AppleSmartBattery record. Macs without a battery have no
+// record, which is not an error: installed is false.
+func getSmartBattery() (smartBattery, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/ioreg", "-rn", "AppleSmartBattery")
+	if err != nil {
+		return smartBattery{}, fmt.Errorf("ioreg AppleSmartBattery failed: %w", err)
+	}
+	if output == "" {
+		return smartBattery{}, nil
+	}
+
+	return parseSmartBattery(parseIORegRecord(output)), nil
+}
+
+func parseSmartBattery(record map[string]string) smartBattery {
+	b := smartBattery{
+		installed:         record["BatteryInstalled"] == "Yes",
+		isCharging:        record["IsCharging"] == "Yes",
+		externalConnected: record["ExternalConnected"] == "Yes",
+		fullyCharged:      record["FullyCharged"] == "Yes",
+		timeToEmpty:       -1,
+		timeToFull:        -1,
+		systemPowerIn:     -1,
+	}
+
+	b.cycleCount, _ = ioregInt(record, "CycleCount")
+	if p, ok := ioregNestedInt(record, "PowerTelemetryData", "SystemPowerIn"); ok {
+		b.systemPowerIn = p
+	}
+	b.designCapacity, _ = ioregInt(record, "DesignCapacity")
+	b.voltage, _ = ioregInt(record, "Voltage")
+	b.amperage, _ = ioregInt(record, "Amperage")
+	b.adapterWatts, _ = ioregNestedInt(record, "AdapterDetails", "Watts")
+
+	// On Apple Silicon MaxCapacity/CurrentCapacity are percentages and the
+	// mAh values are in AppleRawMaxCapacity/AppleRawCurrentCapacity
+	var ok bool
+	if b.maxCapacity, ok = ioregInt(record, "AppleRawMaxCapacity"); !ok {
+		b.maxCapacity, _ = ioregInt(record, "MaxCapacity")
+	}
+	if b.currentCapacity, ok = ioregInt(record, "AppleRawCurrentCapacity"); !ok {
+		b.currentCapacity, _ = ioregInt(record, "CurrentCapacity")
+	}
+
+	// 65535 means the time is still being calculated
+	if t, ok := ioregInt(record, "AvgTimeToEmpty"); ok && t < 65535 {
+		b.timeToEmpty = t
+	}
+	if t, ok := ioregInt(record, "AvgTimeToFull"); ok && t < 65535 {
+		b.timeToFull = t
+	}
+
+	if t, ok := ioregInt(record, "Temperature"); ok {
+		b.temperature = float64(t) / 100.0
+	}
+
+	return b
+}
+
+// health returns the maximum capacity as a percentage of the design capacity
+func (b smartBattery) health() (float64, bool) {
+	if b.designCapacity <= 0 || b.maxCapacity <= 0 {
+		return 0, false
+	}
+	return float64(b.maxCapacity) / float64(b.designCapacity) * 100, true
+}
+
+func (b smartBattery) chargingState() string {
+	switch {
+	case b.fullyCharged:
+		return "charged"
+	case b.isCharging:
+		return "charging"
+	case b.externalConnected:
+		// On AC power but not charging, e.g. optimized battery charging holding at 80%
+		return "not_charging"
+	default:
+		return "discharging"
+	}
+}
+
+// getSystemPower returns the instantaneous system power draw in watts.
+// On AC power it uses SystemPowerIn from the battery's power telemetry (Apple Silicon);
+// on battery power it is the battery voltage × discharge current.
+func getSystemPower(b smartBattery) (float64, bool) {
+	if b.externalConnected && b.systemPowerIn >= 0 {
+		return float64(b.systemPowerIn) / 1000.0, true
+	}
+
+	if b.amperage < 0 && b.voltage > 0 {
+		return float64(b.voltage) * float64(-b.amperage) / 1e6, true
+	}
+
+	// On AC without telemetry (Intel) the battery current is charging current, not system load
+	return 0, false
+}
+
+// getWallPower returns the power drawn from the power adapter in watts, which is what
+// the energy sensor integrates. SystemPowerIn already includes the power going into
+// the battery, so nothing is counted on battery power or the charge would count twice.
+func getWallPower(b smartBattery) (float64, bool) {
+	if !b.externalConnected {
+		return 0, true
+	}
+	if b.systemPowerIn >= 0 {
+		return float64(b.systemPowerIn) / 1000.0, true
+	}
+	return 0, false
+}
+
+// maxEnergySampleGap is the longest gap between power samples that is integrated;
+// longer gaps (sleep, agent restarts) are skipped rather than guessed
+const maxEnergySampleGap = 2 * time.Minute
+
+// energyMeter integrates power samples into energy
+type energyMeter struct {
+	lastPower float64
+	lastTime  time.Time
+	mu        sync.Mutex
+}
+
+var energy = &energyMeter{}
+
+// add records a power sample and returns the total energy in kWh
+func (m *energyMeter) add(watts float64, now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastTime.IsZero() {
+		gap := now.Sub(m.lastTime)
+		if gap > 0 && gap <= maxEnergySampleGap {
+			// Trapezoidal integration between the two samples
+			wh := (m.lastPower + watts) / 2 * gap.Hours()
+			state.addEnergy(wh / 1000.0)
+		}
+	}
+
+	m.lastPower = watts
+	m.lastTime = now
+	return state.energy()
+}
+
+func updatePower(client mqtt.Client) {
+	if !hasBattery() {
+		return
+	}
+
+	b, err := getSmartBattery()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: %v", err)
+		}
+		return
+	}
+
+	prefix := getTopicPrefix()
+
+	if watts, ok := getSystemPower(b); ok {
+		token := publishMQTT(client, prefix+"/status/power", 0, false, fmt.Sprintf("%.2f", watts))
+		token.Wait()
+	}
+
+	// Without a wall power reading (Intel on AC) the sample is skipped, the gap
+	// check in energyMeter then leaves the time until the next reading out
+	if watts, ok := getWallPower(b); ok {
+		kwh := energy.add(watts, time.Now())
+
+		token := publishMQTT(client, prefix+"/status/energy", 0, false, fmt.Sprintf("%.4f", kwh))
+		token.Wait()
+	}
+}
+
+// batteryPresence caches whether this Mac has a battery, once ioreg answered
+var batteryPresence struct {
+	present bool
+	known   bool
+	failed  bool // a check failed before the presence was known
+	mu      sync.Mutex
+}
+
+// checkBattery reports whether this Mac has a battery. known is false while ioreg
+// fails, so a transient failure neither hides nor retires the battery entities.
+func checkBattery() (present, known bool) {
+	batteryPresence.mu.Lock()
+	defer batteryPresence.mu.Unlock()
+
+	if batteryPresence.known {
+		return batteryPresence.present, true
+	}
+
+	b, err := getSmartBattery()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to check for a battery: %v", err)
+		}
+		batteryPresence.failed = true
+		return false, false
+	}
+
+	batteryPresence.present = b.installed
+	batteryPresence.known = true
+	if !b.installed {
+		log.Println("No battery found, battery sensors disabled")
+	}
+	return batteryPresence.present, true
+}
+
+// hasBattery reports whether this Mac has a battery; desktops skip all battery entities
+func hasBattery() bool {
+	present, _ := checkBattery()
+	return present
+}
+
+// batteryFoundLate reports, once, that the battery was only found after a failed
+// check, so its entities still have to be discovered
+func batteryFoundLate() bool {
+	batteryPresence.mu.Lock()
+	defer batteryPresence.mu.Unlock()
+
+	if batteryPresence.known && batteryPresence.present && batteryPresence.failed {
+		batteryPresence.failed = false
+		return true
+	}
+	return false
+}
+
+// batteryEntity is a battery telemetry sensor published from the AppleSmartBattery record
+type batteryEntity struct {
+	id     string
+	name   string
+	config map[string]interface{}
+	value  func(b smartBattery) (string, bool)
+}
+
+var batteryEntities = []batteryEntity{
+	{"battery_cycle_count", "Battery Cycle Count", map[string]interface{}{
+		"state_class":     "total_increasing",
+		"icon":            "mdi:battery-sync",
+		"entity_category": "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.cycleCount), true
+	}},
+	{"battery_health", "Battery Health", map[string]interface{}{
+		"unit_of_measurement":         "%",
+		"state_class":                 "measurement",
+		"suggested_display_precision": 1,
+		"icon":                        "mdi:battery-heart-variant",
+		"entity_category":             "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		health, ok := b.health()
+		return fmt.Sprintf("%.1f", health), ok
+	}},
+	{"battery_design_capacity", "Battery Design Capacity", map[string]interface{}{
+		"unit_of_measurement": "mAh",
+		"icon":                "mdi:battery-outline",
+		"entity_category":     "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.designCapacity), b.designCapacity > 0
+	}},
+	{"battery_max_capacity", "Battery Max Capacity", map[string]interface{}{
+		"unit_of_measurement": "mAh",
+		"state_class":         "measurement",
+		"icon":                "mdi:battery",
+		"entity_category":     "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.maxCapacity), b.maxCapacity > 0
+	}},
+	{"battery_charging_state", "Battery Charging State", map[string]interface{}{
+		"device_class": "enum",
+		"options":      []string{"charging", "discharging", "charged", "not_charging"},
+		"icon":         "mdi:battery-charging",
+	}, func(b smartBattery) (string, bool) {
+		return b.chargingState(), true
+	}},
+	{"battery_time_to_empty", "Battery Time to Empty", map[string]interface{}{
+		"unit_of_measurement": "min",
+		"device_class":        "duration",
+		"icon":                "mdi:battery-clock",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.timeToEmpty), b.timeToEmpty >= 0 && !b.externalConnected
+	}},
+	{"battery_time_to_full", "Battery Time to Full", map[string]interface{}{
+		"unit_of_measurement": "min",
+		"device_class":        "duration",
+		"icon":                "mdi:battery-clock-outline",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.timeToFull), b.timeToFull >= 0 && b.isCharging
+	}},
+	{"battery_voltage", "Battery Voltage", map[string]interface{}{
+		"unit_of_measurement": "V",
+		"device_class":        "voltage",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		return fmt.Sprintf("%.3f", float64(b.voltage)/1000.0), b.voltage > 0
+	}},
+	{"battery_current", "Battery Current", map[string]interface{}{
+		"unit_of_measurement": "A",
+		"device_class":        "current",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+	}, func(b smartBattery) (string, bool) {
+		return fmt.Sprintf("%.3f", float64(b.amperage)/1000.0), true
+	}},
+	{"battery_adapter_power", "Power Adapter", map[string]interface{}{
+		"unit_of_measurement": "W",
+		"device_class":        "power",
+		"icon":                "mdi:power-plug",
+	}, func(b smartBattery) (string, bool) {
+		return strconv.Itoa(b.adapterWatts), b.externalConnected && b.adapterWatts > 0
+	}},
+}
+
+func publishBatteryEntities(client mqtt.Client, device map[string]interface{}) {
+	prefix := getTopicPrefix()
+
+	for _, e := range batteryEntities {
+		entityConfig := map[string]interface{}{
+			"name":                  e.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + e.id,
+			"state_topic":           prefix + "/status/" + e.id,
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		for k, v := range e.config {
+			entityConfig[k] = v
+		}
+		publishConfig(client, "sensor", hostname+"_"+e.id, entityConfig)
+	}
+}
+
+// powerSource is the power state reported by pmset
+type powerSource struct {
+	source      string // AC Power, Battery Power or UPS Power
+	percent     string // battery charge, "" without a battery
+	adapterName string
+}
+
+func (p powerSource) onAC() bool {
+	return p.source == "AC Power"
+}
+
+// parsePmsetBatt parses `pmset -g batt` output:
+// "Now drawing from 'Battery Power'" followed by
+// "-InternalBattery-0 (id=4653155)  100%; discharging; 20:00 remaining present: true"
+func parsePmsetBatt(output string) powerSource {
+	var p powerSource
+
+	if m := regexp.MustCompile(`Now drawing from '([^']+)'`).FindStringSubmatch(output); m != nil {
+		p.source = m[1]
+	}
+	if m := regexp.MustCompile(`(\d+)%`).FindStringSubmatch(output); m != nil {
+		p.percent = m[1]
+	}
+
+	return p
+}
+
+// parsePmsetAdapter parses the "Name = 96W USB-C Power Adapter" line of `pmset -g adapter` output
+func parsePmsetAdapter(output string, p *powerSource) {
+	if m := regexp.MustCompile(`(?m)^\s*Name = (.+)$`).FindStringSubmatch(output); m != nil {
+		p.adapterName = strings.TrimSpace(m[1])
+	}
+}
+
+func getPowerSource() (powerSource, error) {
+	output, err := tryGetCommandOutput("/usr/bin/pmset", "-g", "batt")
+	if err != nil {
+		return powerSource{}, fmt.Errorf("pmset -g batt failed: %w", err)
+	}
+	p := parsePmsetBatt(output)
+
+	if p.onAC() {
+		if adapter, err := tryGetCommandOutput("/usr/bin/pmset", "-g", "adapter"); err == nil {
+			parsePmsetAdapter(adapter, &p)
+		}
+	}
+
+	return p, nil
+}
+
+// lastPowerSource remembers the previous power source to detect plug/unplug
+var lastPowerSource struct {
+	source string
+	mu     sync.Mutex
+}
+
+func updatePowerSource(client mqtt.Client) {
+	p, err := getPowerSource()
+	if err != nil || p.source == "" {
+		if debugMode {
+			log.Printf("Warning: failed to get power source: %v", err)
+		}
+		return
+	}
+
+	prefix := getTopicPrefix()
+
+	lastPowerSource.mu.Lock()
+	previous := lastPowerSource.source
+	lastPowerSource.source = p.source
+	lastPowerSource.mu.Unlock()
+
+	if previous != "" && previous != p.source {
+		eventType := "unplugged"
+		if p.onAC() {
+			eventType = "plugged_in"
+		}
+		log.Printf("Power source changed: %s -> %s", previous, p.source)
+		publishEvent(client, prefix+"/status/power_source_event", eventType, map[string]string{
+			"source":          p.source,
+			"previous_source": previous,
+		})
+	}
+
+	token := publishMQTT(client, prefix+"/status/ac_power", 0, false, strconv.FormatBool(p.onAC()))
+	token.Wait()
+
+	token = publishMQTT(client, prefix+"/status/power_source", 0, false, p.source)
+	token.Wait()
+
+	if !hasBattery() {
+		// Desktops are always on AC and report no adapter
+		return
+	}
+
+	token = publishMQTT(client, prefix+"/status/power_adapter_name", 0, false, p.adapterName)
+	token.Wait()
+}
+
+func getBatteryChargePercent() string {
+
+	output := getCommandOutput("/usr/bin/pmset", "-g", "batt")
+
+	return parsePmsetBatt(output).percent
+}
+
+func updateBattery(client mqtt.Client) {
+	if !hasBattery() {
+		return
+	}
+	if batteryFoundLate() {
+		publishDiscoveryMessages(client)
+		publishCapabilities(client)
+	}
+
+	prefix := getTopicPrefix()
+
+	if percent := getBatteryChargePercent(); percent != "" {
+		token := publishMQTT(client, prefix+"/status/battery", 0, false, percent)
+		token.Wait()
+	}
+
+	b, err := getSmartBattery()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: %v", err)
+		}
+		return
+	}
+	for _, e := range batteryEntities {
+		value, ok := e.value(b)
+		if !ok {
+			continue
+		}
+		token := publishMQTT(client, prefix+"/status/"+e.id, 0, false, value)
+		token.Wait()
+	}
+}
+
+func getSystemUptime() string {
+	output := getCommandOutput("/usr/sbin/sysctl", "-n", "kern.boottime")
+
+	// Parse boot time: { sec = 1766859018, usec = 483520 } Sat Dec 27 19:10:18 2025
+	r := regexp.MustCompile(`sec = (\d+)`)
+	matches := r.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return ""
+	}
+
+	bootTimeSec, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return ""
+	}
+
+	// Return ISO 8601 timestamp for Home Assistant timestamp sensor
+	bootTime := time.Unix(bootTimeSec, 0)
+	return bootTime.Format(time.RFC3339)
+}
+
+func updateSystemUptime(client mqtt.Client) {
+	token := publishMQTT(client, getTopicPrefix()+"/status/uptime", 0, false, getSystemUptime())
+	token.Wait()
+}
+
+func getActiveApp() string {
+	output := getCommandOutput("/usr/bin/osascript", "-e", "tell application \"System Events\" to get name of first application process whose frontmost is true")
+	return output
+}
+
+func updateActiveApp(client mqtt.Client) {
+	token := publishMQTT(client, getTopicPrefix()+"/status/active_app", 0, false, getActiveApp())
+	token.Wait()
+}
+
+// nowPlaying describes the track of the active media player
+type nowPlaying struct {
+	source   string // Music, Spotify, or "" when nothing is playing
+	state    string // playing, paused, stopped or idle
+	title    string
+	artist   string
+	album    string
+	position float64 // seconds
+	duration float64 // seconds
+}
+
+// mediaPlayer is an application that can be queried and controlled through AppleScript
+type mediaPlayer struct {
+	app string
+	// durationScale converts the player's track duration into seconds
+	durationScale float64
+}
+
+// mediaPlayers are checked in order; a playing player wins over a paused one
+var mediaPlayers = []mediaPlayer{
+	{app: "Music", durationScale: 1},
+	{app: "Spotify", durationScale: 0.001},
+}
+
+// mediaFieldSeparator separates the fields of the now playing record (ASCII unit separator)
+const mediaFieldSeparator = "\x1f"
+
+// isAppRunning reports whether an application process with the exact name is running.
+// Players are checked this way first because `tell application` would launch them.
+func isAppRunning(name string) bool {
+	return exec.Command("/usr/bin/pgrep", "-xq", name).Run() == nil
+}
+
+func getPlayerState(p mediaPlayer) (nowPlaying, bool) {
+	script := `tell application "` + p.app + `"
+	set s to player state as string
+	if s is "stopped" then return s
+	set t to current track
+	set sep to character id 31
+	return s & sep & (name of t) & sep & (artist of t) & sep & (album of t) & sep & (player position as string) & sep & (duration of t as string)
+end tell`
+
+	output, err := tryGetCommandOutput("/usr/bin/osascript", "-e", script)
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get %s player state: %v", p.app, err)
+		}
+		return nowPlaying{}, false
+	}
+
+	np := nowPlaying{source: p.app}
+	fields := strings.Split(output, mediaFieldSeparator)
+	np.state = fields[0]
+	if len(fields) == 6 {
+		np.title = fields[1]
+		np.artist = fields[2]
+		np.album = fields[3]
+		np.position = parseAppleScriptNumber(fields[4])
+		np.duration = parseAppleScriptNumber(fields[5]) * p.durationScale
+	}
+
+	return np, true
+}
+
+// parseAppleScriptNumber parses a real coerced to text, which uses the
+// locale's decimal separator (e.g. "12,5" on a German system)
+func parseAppleScriptNumber(s string) float64 {
+	f, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(s), ",", ".", 1), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+func getNowPlaying() nowPlaying {
+	var paused, stopped *nowPlaying
+
+	for _, p := range mediaPlayers {
+		if !isAppRunning(p.app) {
+			continue
+		}
+
+		np, ok := getPlayerState(p)
+		if !ok {
+			continue
+		}
+		if np.state == "playing" {
+			return np
+		}
+		if np.state == "paused" && paused == nil {
+			paused = &np
+		}
+		if np.state == "stopped" && stopped == nil {
+			stopped = &np
+		}
+	}
+
+	if paused != nil {
+		return *paused
+	}
+	if stopped != nil {
+		return *stopped
+	}
+	return nowPlaying{state: "idle"}
+}
+
+// mediaState remembers the last detected player and track
+type mediaState struct {
+	current     nowPlaying
+	artwork     string // track the published artwork belongs to
+	contentType string // image format announced for the artwork
+	mu          sync.Mutex
+}
+
+var media = &mediaState{contentType: "image/jpeg"}
+
+func (s *mediaState) artworkContentType() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.contentType
+}
+
+// publishArtworkConfig announces the artwork image entity. Home Assistant takes the
+// image format from the discovery config, so it is announced again when the format changes.
+func publishArtworkConfig(client mqtt.Client, contentType string) {
+	prefix := getTopicPrefix()
+
+	mediaArtworkConfig := map[string]interface{}{
+		"name":                  "Media Artwork",
+		"unique_id":             "mac2mqtt_" + hostname + "_media_artwork",
+		"image_topic":           prefix + "/status/media_artwork",
+		"content_type":          contentType,
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                getDeviceInfo(),
+	}
+	publishConfig(client, "image", hostname+"_media_artwork", mediaArtworkConfig)
+}
+
+func (n nowPlaying) trackKey() string {
+	return strings.Join([]string{n.source, n.title, n.artist, n.album}, mediaFieldSeparator)
+}
+
+// getArtwork returns the cover image of the current track of the given player
+func getArtwork(np nowPlaying) ([]byte, error) {
+	switch np.source {
+	case "Music":
+		tmpFile, err := os.CreateTemp("", "mac2mqtt-artwork-*")
+		if err != nil {
+			return nil, err
+		}
+		tmpPath := tmpFile.Name()
+		tmpFile.Close()
+		defer os.Remove(tmpPath)
+
+		script := `on run argv
+	tell application "Music"
+		if (count of artworks of current track) is 0 then return "none"
+		set artData to raw data of artwork 1 of current track
+	end tell
+	set f to open for access POSIX file (item 1 of argv) with write permission
+	set eof f to 0
+	write artData to f
+	close access f
+	return "ok"
+end run`
+		output, err := tryGetCommandOutput("/usr/bin/osascript", "-e", script, tmpPath)
+		if err != nil {
+			return nil, err
+		}
+		if output != "ok" {
+			return nil, nil
+		}
+		return os.ReadFile(tmpPath)
+
+	case "Spotify":
+		url, err := tryGetCommandOutput("/usr/bin/osascript", "-e", `tell application "Spotify" to get artwork url of current track`)
+		if err != nil || url == "" {
+			return nil, err
+		}
+
+		client := &http.Client{
+			Timeout: 10 * time.Second,
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download artwork: %w", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("artwork download failed with status %d", resp.StatusCode)
+		}
+		return io.ReadAll(resp.Body)
+	}
+
+	return nil, nil
+}
+
+func updateNowPlaying(client mqtt.Client) {
+	np := getNowPlaying()
+
+	media.mu.Lock()
+	media.current = np
+	artworkChanged := media.artwork != np.trackKey()
+	media.artwork = np.trackKey()
+	media.mu.Unlock()
+
+	prefix := getTopicPrefix()
+
+	values := []struct {
+		topic string
+		value string
+	}{
+		{"/status/media_state", np.state},
+		{"/status/media_source", np.source},
+		{"/status/media_title", np.title},
+		{"/status/media_artist", np.artist},
+		{"/status/media_album", np.album},
+	}
+	for _, v := range values {
+		token := publishMQTT(client, prefix+v.topic, 0, false, v.value)
+		token.Wait()
+	}
+
+	if artworkChanged {
+		// Spotify artwork is downloaded, which must not hold up the 2 second updates
+		go updateArtwork(client, np)
+	}
+}
+
+// updateArtwork publishes the cover image of the track, unless the track changed
+// while it was fetched. The last image stays when fetching fails.
+func updateArtwork(client mqtt.Client, np nowPlaying) {
+	artwork, err := getArtwork(np)
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get artwork: %v", err)
+		}
+		return
+	}
+	if artwork == nil {
+		// Empty payload clears the image in Home Assistant
+		artwork = []byte{}
+	}
+
+	// Music returns the artwork as stored in the file, which can be PNG as well as JPEG
+	contentType := ""
+	if len(artwork) > 0 {
+		if detected := http.DetectContentType(artwork); strings.HasPrefix(detected, "image/") {
+			contentType = detected
+		}
+	}
+
+	media.mu.Lock()
+	current := media.artwork == np.trackKey()
+	formatChanged := current && contentType != "" && contentType != media.contentType
+	if formatChanged {
+		media.contentType = contentType
+	}
+	media.mu.Unlock()
+	if !current {
+		return
+	}
+
+	if formatChanged {
+		publishArtworkConfig(client, contentType)
+	}
+
+	// Retained so the image survives Home Assistant restarts; it only changes per track
+	token := publishMQTT(client, getTopicPrefix()+"/status/media_artwork", 0, true, artwork)
+	token.Wait()
+}
+
+// mediaTarget returns the player that media commands are sent to:
+// the last detected player, or the first running one
+func mediaTarget() string {
+	media.mu.Lock()
+	source := media.current.source
+	media.mu.Unlock()
+
+	if source != "" {
+		return source
+	}
+	for _, p := range mediaPlayers {
+		if isAppRunning(p.app) {
+			return p.app
+		}
+	}
+	return ""
+}
+
+var mediaCommands = map[string]string{
+	"play":      "play",
+	"pause":     "pause",
+	"playpause": "playpause",
+	"next":      "next track",
+	"previous":  "previous track",
+}
+
+func commandMedia(action string) {
+	app := mediaTarget()
+	if app == "" {
+		log.Println("No media player running")
+		return
+	}
+
+	if _, err := tryGetCommandOutput("/usr/bin/osascript", "-e", `tell application "`+app+`" to `+mediaCommands[action]); err != nil {
+		log.Printf("Media command %s failed for %s: %v", action, app, err)
+	}
+}
+
+// commandMediaSeek moves the playback position; value is an absolute position
+// in seconds (int) or a relative offset such as "+15" or "-10" (string)
+func commandMediaSeek(value interface{}) {
+	app := mediaTarget()
+	if app == "" {
+		log.Println("No media player running")
+		return
+	}
+
+	var position float64
+	switch v := value.(type) {
+	case int:
+		position = float64(v)
+	case string:
+		offset, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("Incorrect value for command media_seek: %v", err)
+			return
+		}
+		// A relative seek needs the current position, without it the track would restart
+		found := false
+		for _, p := range mediaPlayers {
+			if p.app != app {
+				continue
+			}
+			if np, ok := getPlayerState(p); ok {
+				position = np.position + float64(offset)
+				found = true
+			}
+		}
+		if !found {
+			log.Printf("Media seek failed for %s: current position unknown", app)
+			return
+		}
+	}
+	if position < 0 {
+		position = 0
+	}
+
+	script := `tell application "` + app + `" to set player position to ` + strconv.FormatFloat(position, 'f', 1, 64)
+	if _, err := tryGetCommandOutput("/usr/bin/osascript", "-e", script); err != nil {
+		log.Printf("Media seek failed for %s: %v", app, err)
+	}
+}
+
+// brightnessDisplay is a display whose brightness can be read and set
+type brightnessDisplay struct {
+	id         string // "builtin_<n>" or "ddc_<n>", numbered as by the helper tool
+	name       string
+	brightness int // 0-100
+}
+
+// getBuiltinBrightness reads the built-in display brightness using the brightness helper
+func getBuiltinBrightness() []brightnessDisplay {
+	path := findHelper("brightness")
+	if path == "" {
+		return nil
+	}
+
+	output, err := tryGetCommandOutput(path, "-l")
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: brightness -l failed: %v", err)
+		}
+		return nil
+	}
+
+	return parseBuiltinBrightness(output)
+}
+
+// parseBuiltinBrightness parses `brightness -l` output, e.g.
+// display 0: main, active, awake, online, built-in, ID 0x4280a80
+// display 0: brightness 0.687500
+func parseBuiltinBrightness(output string) []brightnessDisplay {
+	builtIn := make(map[string]bool)
+	var displays []brightnessDisplay
+
+	r := regexp.MustCompile(`^display (\d+): (.+)$`)
+	for _, line := range strings.Split(output, "\n") {
+		m := r.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+
+		index, details := m[1], m[2]
+		if strings.Contains(details, "built-in") {
+			builtIn[index] = true
+			continue
+		}
+
+		if !builtIn[index] || !strings.HasPrefix(details, "brightness ") {
+			continue
+		}
+		level, err := strconv.ParseFloat(strings.TrimPrefix(details, "brightness "), 64)
+		if err != nil {
+			continue
+		}
+
+		displays = append(displays, brightnessDisplay{
+			id:         "builtin_" + index,
+			name:       "Built-in Display",
+			brightness: int(level*100 + 0.5),
+		})
+	}
+
+	return displays
+}
+
+// ddcLevels caches the DDC luminance per display, as frequent DDC reads make some monitors
+// flicker. A display is read once when it appears and afterwards follows what was set.
+var ddcLevels = struct {
+	levels map[string]brightnessDisplay
+	mu     sync.Mutex
+}{levels: make(map[string]brightnessDisplay)}
+
+// getDDCBrightness returns the brightness (luminance) of external displays using m1ddc,
+// reading it over DDC only for displays that are not cached yet
+func getDDCBrightness() []brightnessDisplay {
+	path := findHelper("m1ddc")
+	if path == "" {
+		return nil
+	}
+
+	output, err := tryGetCommandOutput(path, "display", "list")
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: m1ddc display list failed: %v", err)
+		}
+		return nil
+	}
+
+	// [1] DELL U2720Q (6A3B8C2E-0000-0000-0000-000000000000)
+	r := regexp.MustCompile(`^\[(\d+)\]\s+(.+?)(?:\s+\(.*\))?$`)
+
+	ddcLevels.mu.Lock()
+	defer ddcLevels.mu.Unlock()
+
+	var displays []brightnessDisplay
+	present := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		m := r.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+
+		id := "ddc_" + m[1]
+		present[id] = true
+		if cached, ok := ddcLevels.levels[id]; ok && cached.name == m[2] {
+			displays = append(displays, cached)
+			continue
+		}
+
+		level, err := tryGetCommandOutput(path, "display", m[1], "get", "luminance")
+		if err != nil {
+			// Not every external display supports DDC
+			continue
+		}
+		brightness, err := strconv.Atoi(strings.TrimSpace(level))
+		if err != nil {
+			continue
+		}
+
+		d := brightnessDisplay{
+			id:         id,
+			name:       m[2],
+			brightness: brightness,
+		}
+		ddcLevels.levels[id] = d
+		displays = append(displays, d)
+	}
+
+	// Read a display again when it is reconnected
+	for id := range ddcLevels.levels {
+		if !present[id] {
+			delete(ddcLevels.levels, id)
+		}
+	}
+
+	return displays
+}
+
+func getDisplayBrightness() []brightnessDisplay {
+	return append(getBuiltinBrightness(), getDDCBrightness()...)
+}
+
+// setDisplayBrightness sets the brightness (0-100) of the display with the given id
+func setDisplayBrightness(id string, level int) error {
+	switch {
+	case strings.HasPrefix(id, "builtin_"):
+		path := findHelper("brightness")
+		if path == "" {
+			return fmt.Errorf("brightness helper not installed")
+		}
+		output, err := exec.Command(path, "-d", strings.TrimPrefix(id, "builtin_"), strconv.FormatFloat(float64(level)/100, 'f', 2, 64)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("brightness failed: %v (%s)", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+
+	case strings.HasPrefix(id, "ddc_"):
+		path := findHelper("m1ddc")
+		if path == "" {
+			return fmt.Errorf("m1ddc helper not installed")
+		}
+		output, err := exec.Command(path, "display", strings.TrimPrefix(id, "ddc_"), "set", "luminance", strconv.Itoa(level)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("m1ddc failed: %v (%s)", err, strings.TrimSpace(string(output)))
+		}
+
+		ddcLevels.mu.Lock()
+		if d, ok := ddcLevels.levels[id]; ok {
+			d.brightness = level
+			ddcLevels.levels[id] = d
+		}
+		ddcLevels.mu.Unlock()
+		return nil
+	}
+
+	return fmt.Errorf("unknown display %q", id)
+}
+
+// brightnessState caches the displays last announced to Home Assistant
+type brightnessState struct {
+	displays  []brightnessDisplay
+	published bool
+	mu        sync.Mutex
+}
+
+var brightness = &brightnessState{}
+
+func (s *brightnessState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
+}
+
+func (s *brightnessState) ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, len(s.displays))
+	for _, d := range s.displays {
+		ids = append(ids, d.id)
+	}
+	return ids
+}
+
+// store saves the displays and returns the ones that disappeared, and whether
+// the number entities need (re)publishing
+func (s *brightnessState) store(displays []brightnessDisplay) (removed []brightnessDisplay, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := make(map[string]string)
+	for _, d := range displays {
+		current[d.id] = d.name
+	}
+
+	changed = !s.published || len(s.displays) != len(displays)
+	for _, d := range s.displays {
+		name, ok := current[d.id]
+		if !ok {
+			removed = append(removed, d)
+		}
+		if name != d.name {
+			changed = true
+		}
+	}
+
+	s.displays = displays
+	s.published = true
+	return removed, changed
+}
+
+func publishBrightnessNumbers(client mqtt.Client, displays []brightnessDisplay) {
+	prefix := getTopicPrefix()
+	device := getDeviceInfo()
+
+	for _, d := range displays {
+		numberConfig := map[string]interface{}{
+			"name":                  d.name + " Brightness",
+			"unique_id":             "mac2mqtt_" + hostname + "_brightness_" + d.id,
+			"state_topic":           prefix + "/status/brightness_" + d.id,
+			"command_topic":         prefix + "/command/brightness",
+			"command_template":      `{"display": "` + d.id + `", "brightness": {{ value | int }}}`,
+			"min":                   0,
+			"max":                   100,
+			"step":                  1,
+			"unit_of_measurement":   "%",
+			"icon":                  "mdi:brightness-6",
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		publishConfig(client, "number", hostname+"_brightness_"+d.id, numberConfig)
+	}
+}
+
+func updateBrightness(client mqtt.Client) {
+	displays := getDisplayBrightness()
+
+	removed, changed := brightness.store(displays)
+	for _, d := range removed {
+		removeConfig(client, "number", hostname+"_brightness_"+d.id)
+	}
+	if changed {
+		publishBrightnessNumbers(client, displays)
+		publishCapabilities(client)
+	}
+
+	prefix := getTopicPrefix()
+	for _, d := range displays {
+		token := publishMQTT(client, prefix+"/status/brightness_"+d.id, 0, false, strconv.Itoa(d.brightness))
+		token.Wait()
+	}
+}
+
+// handleBrightnessCommand sets one display from {"display": ID, "brightness": N},
+// or every display when the payload is a plain level
+func handleBrightnessCommand(client mqtt.Client, value interface{}) {
+	targets := brightness.ids()
+	var level int
+
+	switch v := value.(type) {
+	case int:
+		level = v
+	case json.RawMessage:
+		var req struct {
+			Display    string `json:"display"`
+			Brightness *int   `json:"brightness"`
+		}
+		if err := json.Unmarshal(v, &req); err != nil || req.Brightness == nil {
+			log.Println("Incorrect value for command brightness: expected {\"display\": ID, \"brightness\": 0-100}")
+			return
+		}
+		level = *req.Brightness
+		targets = []string{req.Display}
+	}
+
+	if level < 0 || level > 100 {
+		log.Printf("Incorrect value for command brightness: %d is out of range 0..100", level)
+		return
+	}
+
+	for _, id := range targets {
+		if err := setDisplayBrightness(id, level); err != nil {
+			log.Printf("Failed to set brightness of display %s: %v", id, err)
+		}
+	}
+
+	updateBrightness(client)
+}
+
+// displayInfo describes a connected display as reported by system_profiler
+type displayInfo struct {
+	Name        string  `json:"name"`
+	ID          string  `json:"id,omitempty"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	RefreshRate float64 `json:"refresh_rate,omitempty"`
+	Main        bool    `json:"main"`
+	Connection  string  `json:"connection"`
+}
+
+func (d displayInfo) resolution() string {
+	return fmt.Sprintf("%dx%d", d.Width, d.Height)
+}
+
+// key identifies a display across polls
+func (d displayInfo) key() string {
+	if d.ID != "" {
+		return d.ID
+	}
+	return d.Name
+}
+
+type spDisplaysData struct {
+	SPDisplaysDataType []struct {
+		Displays []map[string]interface{} `json:"spdisplays_ndrvs"`
+	} `json:"SPDisplaysDataType"`
+}
+
+func getDisplays() ([]displayInfo, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/system_profiler", "SPDisplaysDataType", "-json")
+	if err != nil {
+		return nil, fmt.Errorf("system_profiler SPDisplaysDataType failed: %w", err)
+	}
+
+	return parseDisplays([]byte(output))
+}
+
+func parseDisplays(data []byte) ([]displayInfo, error) {
+	var sp spDisplaysData
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return nil, fmt.Errorf("failed to parse SPDisplaysDataType: %w", err)
+	}
+
+	// "3024 x 1964 @ 120.00Hz" (Apple Silicon) or "2560 x 1440 @ 60 Hz" (Intel)
+	r := regexp.MustCompile(`(\d+) x (\d+)(?:.*@ ([\d.]+)\s*Hz)?`)
+
+	var displays []displayInfo
+	for _, gpu := range sp.SPDisplaysDataType {
+		for _, raw := range gpu.Displays {
+			str := func(key string) string {
+				s, _ := raw[key].(string)
+				return s
+			}
+
+			d := displayInfo{
+				Name: str("_name"),
+				ID:   str("_spdisplays_displayID"),
+				Main: str("spdisplays_main") == "spdisplays_yes",
+			}
+
+			resolution := str("_spdisplays_resolution")
+			if resolution == "" {
+				resolution = str("spdisplays_resolution")
+			}
+			if m := r.FindStringSubmatch(resolution); m != nil {
+				d.Width, _ = strconv.Atoi(m[1])
+				d.Height, _ = strconv.Atoi(m[2])
+				if m[3] != "" {
+					d.RefreshRate, _ = strconv.ParseFloat(m[3], 64)
+				}
+			}
+
+			switch connection := str("spdisplays_connection_type"); connection {
+			case "spdisplays_internal":
+				d.Connection = "internal"
+			case "":
+				d.Connection = "external"
+			default:
+				d.Connection = strings.TrimPrefix(connection, "spdisplays_")
+			}
+
+			displays = append(displays, d)
+		}
+	}
+
+	return displays, nil
+}
+
+// displayState remembers the displays seen on the previous poll to detect changes
+type displayState struct {
+	displays []displayInfo
+	seen     bool
+	mu       sync.Mutex
+}
+
+var displays = &displayState{}
+
+// store saves the displays and returns those connected and disconnected since the previous poll
+func (s *displayState) store(current []displayInfo) (connected, disconnected []displayInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seen {
+		connected = diffDisplays(current, s.displays)
+		disconnected = diffDisplays(s.displays, current)
+	}
+
+	s.displays = current
+	s.seen = true
+	return connected, disconnected
+}
+
+// diffDisplays returns the displays in a that are not in b
+func diffDisplays(a, b []displayInfo) []displayInfo {
+	keys := make(map[string]bool)
+	for _, d := range b {
+		keys[d.key()] = true
+	}
+
+	var diff []displayInfo
+	for _, d := range a {
+		if !keys[d.key()] {
+			diff = append(diff, d)
+		}
+	}
+	return diff
+}
+
+func updateDisplays(client mqtt.Client) {
+	current, err := getDisplays()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get displays: %v", err)
+		}
+		return
+	}
+
+	prefix := getTopicPrefix()
+
+	connected, disconnected := displays.store(current)
+	for _, d := range connected {
+		log.Printf("Display connected: %s", d.Name)
+		publishEvent(client, prefix+"/status/display_event", "connected", d)
+	}
+	for _, d := range disconnected {
+		log.Printf("Display disconnected: %s", d.Name)
+		publishEvent(client, prefix+"/status/display_event", "disconnected", d)
+	}
+
+	token := publishMQTT(client, prefix+"/status/display_count", 0, false, strconv.Itoa(len(current)))
+	token.Wait()
+
+	attributes, err := json.Marshal(map[string]interface{}{"displays": current})
+	if err == nil {
+		token = publishMQTT(client, prefix+"/status/displays", 0, false, attributes)
+		token.Wait()
+	}
+
+	for _, d := range current {
+		if d.Main {
+			token = publishMQTT(client, prefix+"/status/display_resolution", 0, false, d.resolution())
+			token.Wait()
+			break
+		}
+	}
+}
+
+var ssidWarningOnce sync.Once
+
+// wifiInfo is one snapshot of the Wi-Fi link. Numbers are 0 and strings empty when unknown.
+type wifiInfo struct {
+	iface     string
+	connected bool
+	ssid      string
+	bssid     string
+	rssi      int // dBm
+	noise     int // dBm
+	channel   int
+	band      string // "2.4 GHz", "5 GHz" or "6 GHz"
+	phyMode   string // e.g. "802.11ax"
+	txRate    float64
+	ip        string
+}
+
+// snr returns the signal-to-noise ratio in dB
+func (w wifiInfo) snr() (int, bool) {
+	if w.rssi == 0 || w.noise == 0 {
+		return 0, false
+	}
+	return w.rssi - w.noise, true
+}
+
+// quality maps the signal strength to 0-100%: -50 dBm or better is 100%, -100 dBm or worse is 0%
+func (w wifiInfo) quality() (int, bool) {
+	if w.rssi == 0 {
+		return 0, false
+	}
+	q := 2 * (w.rssi + 100)
+	if q > 100 {
+		q = 100
+	} else if q < 0 {
+		q = 0
+	}
+	return q, true
+}
+
+// connectionQuality rates the signal strength as excellent, good, fair or poor
+func (w wifiInfo) connectionQuality() string {
+	switch {
+	case w.rssi == 0:
+		return ""
+	case w.rssi >= -50:
+		return "excellent"
+	case w.rssi >= -60:
+		return "good"
+	case w.rssi >= -70:
+		return "fair"
+	default:
+		return "poor"
+	}
+}
+
+// lastWiFi remembers the previous link to detect roaming and disconnects
+var lastWiFi struct {
+	info   wifiInfo
+	known  bool
+	mu     sync.Mutex
+	update sync.Mutex // Serializes updateWiFi, run by the poll and the event helper
+}
+
+// wifiBSSIDChanged is set by the CoreWLAN event helper when the access point changed,
+// which tells a roam apart even when macOS redacts the BSSID itself
+var wifiBSSIDChanged atomic.Bool
+
+// wifiEvent compares the link with the previous one and returns the event to publish, if any.
+// Without a BSSID to compare, a roam is only detected from the BSSID change event; a new
+// channel alone is not a roam, as access points move channels themselves (DFS).
+func wifiEvent(previous, current wifiInfo, bssidChanged bool) string {
+	switch {
+	case previous.connected && !current.connected:
+		return "disconnected"
+	case !previous.connected && current.connected:
+		return "connected"
+	case !current.connected:
+		return ""
+	case previous.ssid != current.ssid:
+		// Joined another network without a disconnect in between
+		return "connected"
+	case !isRedacted(previous.bssid) && !isRedacted(current.bssid):
+		if previous.bssid != current.bssid {
+			return "roamed"
+		}
+	case bssidChanged:
+		return "roamed"
+	}
+	return ""
+}
+
+// isRedacted reports whether macOS hid a value for lack of Location Services permission
+func isRedacted(s string) bool {
+	return s == "" || s == "<redacted>" || s == "<SSID Redacted>"
+}
+
+// channelBand guesses the band from a channel number when the source does not report it
+func channelBand(channel int) string {
+	switch {
+	case channel <= 0:
+		return ""
+	case channel <= 14:
+		return "2.4 GHz"
+	default:
+		return "5 GHz"
+	}
+}
+
+// getWiFi collects the Wi-Fi link details once per cycle. airport (older macOS) and
+// system_profiler report everything but the BSSID in one call; ipconfig, networksetup
+// and CoreWLAN are only asked for what is still missing.
+func getWiFi() wifiInfo {
+	info := wifiInfo{iface: getWiFiInterface()}
+
+	if output := getAirportInfo(); output != "" {
+		parseAirportInfo(output, &info)
+	} else if output, err := tryGetCommandOutput("/usr/sbin/system_profiler", "-json", "-detailLevel", "mini", "SPAirPortDataType"); err == nil {
+		if err := parseSPAirPort([]byte(output), &info); err != nil && debugMode {
+			log.Printf("Warning: failed to parse system_profiler SPAirPortDataType: %v", err)
+		}
+	} else if debugMode {
+		log.Printf("Warning: system_profiler SPAirPortDataType failed: %v", err)
+	}
+
+	if info.iface == "" {
+		return info
+	}
+
+	if ip, err := tryGetCommandOutput("/usr/sbin/ipconfig", "getifaddr", info.iface); err == nil && ip != "" {
+		info.ip = ip
+		info.connected = true
+	}
+
+	if !info.connected {
+		return info
+	}
+
+	// Try ipconfig getsummary which can expose SSID and BSSID on some macOS versions
+	if isRedacted(info.ssid) || isRedacted(info.bssid) {
+		if output, err := tryGetCommandOutput("/usr/sbin/ipconfig", "getsummary", info.iface); err == nil {
+			parseIpconfigSummary(output, &info)
+		}
+	}
 
 	// Prefer networksetup (works even when airport binary is missing on newer macOS)
-	if ssid, ok := getSSIDFromNetworksetup(); ok {
-		return ssid
+	if isRedacted(info.ssid) {
+		if output, err := tryGetCommandOutput("/usr/sbin/networksetup", "-getairportnetwork", info.iface); err == nil {
+			if m := regexp.MustCompile(`Current Wi-Fi Network: (.+)`).FindStringSubmatch(output); m != nil {
+				info.ssid = strings.TrimSpace(m[1])
+			}
+		}
+	}
+
+	// Try CoreWLAN via swift as a last resort
+	if isRedacted(info.ssid) {
+		if output, ok := getWiFiInfoViaSwift(); ok {
+			parseAirportInfo(output, &info)
+		}
+	}
+
+	if isRedacted(info.ssid) {
+		info.ssid = ""
+
+		// Log a one-time informational message about SSID restrictions on modern macOS
+		ssidWarningOnce.Do(func() {
+			log.Println("")
+			log.Println("Wi-Fi SSID unavailable - Location Services permission required")
+			printLocationServicesInstructions()
+			log.Println("")
+		})
+	}
+	if isRedacted(info.bssid) {
+		info.bssid = ""
+	}
+	if info.band == "" {
+		info.band = channelBand(info.channel)
+	}
+
+	return info
+}
+
+// parseAirportInfo parses `airport -I` output, which the CoreWLAN fallback mimics:
+//
+//	agrCtlRSSI: -55
+//	agrCtlNoise: -92
+//	lastTxRate: 867
+//	BSSID: aa:bb:cc:dd:ee:ff
+//	SSID: MyNetwork
+//	channel: 149,80
+func parseAirportInfo(output string, info *wifiInfo) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "agrCtlRSSI":
+			info.rssi, _ = strconv.Atoi(value)
+		case "agrCtlNoise":
+			info.noise, _ = strconv.Atoi(value)
+		case "lastTxRate":
+			info.txRate, _ = strconv.ParseFloat(value, 64)
+		case "BSSID":
+			info.bssid = value
+		case "SSID":
+			info.ssid = value
+		case "channel":
+			channel, _, _ := strings.Cut(value, ",")
+			info.channel, _ = strconv.Atoi(channel)
+		case "band":
+			info.band = value
+		case "phyMode":
+			info.phyMode = value
+		case "state":
+			info.connected = value == "running"
+		}
+	}
+
+	if info.rssi != 0 {
+		info.connected = true
+	}
+}
+
+// spAirPortData is the part of `system_profiler -json SPAirPortDataType` used here
+type spAirPortData struct {
+	SPAirPortDataType []struct {
+		Interfaces []struct {
+			Name    string `json:"_name"`
+			Status  string `json:"spairport_status_information"`
+			Current *struct {
+				Name        string      `json:"_name"`
+				Channel     interface{} `json:"spairport_network_channel"`
+				PHYMode     string      `json:"spairport_network_phymode"`
+				Rate        float64     `json:"spairport_network_rate"`
+				SignalNoise string      `json:"spairport_signal_noise"`
+			} `json:"spairport_current_network_information"`
+		} `json:"spairport_airport_interfaces"`
+	} `json:"SPAirPortDataType"`
+}
+
+// parseSPAirPort fills in the current network of the Wi-Fi interface, e.g.
+// "spairport_network_channel": "149 (5GHz, 80MHz)",
+// "spairport_signal_noise": "-56 dBm / -92 dBm"
+func parseSPAirPort(data []byte, info *wifiInfo) error {
+	var sp spAirPortData
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return err
+	}
+
+	for _, item := range sp.SPAirPortDataType {
+		for _, iface := range item.Interfaces {
+			if info.iface != "" && iface.Name != info.iface {
+				continue
+			}
+			if info.iface == "" {
+				info.iface = iface.Name
+			}
+
+			info.connected = iface.Status == "spairport_status_connected"
+			current := iface.Current
+			if current == nil {
+				return nil
+			}
+
+			info.ssid = current.Name
+			info.phyMode = current.PHYMode
+			info.txRate = current.Rate
+
+			channel := fmt.Sprint(current.Channel)
+			if m := regexp.MustCompile(`^(\d+)`).FindStringSubmatch(channel); m != nil {
+				info.channel, _ = strconv.Atoi(m[1])
+			}
+			if m := regexp.MustCompile(`([\d.]+)GHz`).FindStringSubmatch(channel); m != nil {
+				info.band = m[1] + " GHz"
+			}
+
+			if m := regexp.MustCompile(`(-?\d+) dBm / (-?\d+) dBm`).FindStringSubmatch(current.SignalNoise); m != nil {
+				info.rssi, _ = strconv.Atoi(m[1])
+				info.noise, _ = strconv.Atoi(m[2])
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// parseIpconfigSummary picks SSID and BSSID from `ipconfig getsummary`, e.g.
+// "  SSID : MyNetwork" and "  BSSID : aa:bb:cc:dd:ee:ff"
+func parseIpconfigSummary(output string, info *wifiInfo) {
+	if m := regexp.MustCompile(`(?m)^\s*SSID : (.+)$`).FindStringSubmatch(output); m != nil && isRedacted(info.ssid) {
+		info.ssid = strings.TrimSpace(m[1])
+	}
+	if m := regexp.MustCompile(`(?m)^\s*BSSID : (.+)$`).FindStringSubmatch(output); m != nil && isRedacted(info.bssid) {
+		info.bssid = strings.TrimSpace(m[1])
+	}
+}
+
+func updateWiFi(client mqtt.Client) {
+	lastWiFi.update.Lock()
+	defer lastWiFi.update.Unlock()
+
+	info := getWiFi()
+	prefix := getTopicPrefix()
+
+	lastWiFi.mu.Lock()
+	previous, known := lastWiFi.info, lastWiFi.known
+	lastWiFi.info, lastWiFi.known = info, true
+	bssidChanged := wifiBSSIDChanged.Swap(false)
+	lastWiFi.mu.Unlock()
+
+	if eventType := wifiEvent(previous, info, bssidChanged); known && eventType != "" {
+		log.Printf("Wi-Fi %s (BSSID %s -> %s)", eventType, previous.bssid, info.bssid)
+		publishEvent(client, prefix+"/status/wifi_event", eventType, map[string]interface{}{
+			"ssid":           info.ssid,
+			"bssid":          info.bssid,
+			"previous_ssid":  previous.ssid,
+			"previous_bssid": previous.bssid,
+			"rssi":           info.rssi,
+			"channel":        info.channel,
+		})
+	}
+
+	ssid := info.ssid
+	if ssid == "" {
+		ssid = "Not Connected"
+	}
+	ip := info.ip
+	if ip == "" {
+		ip = "Not Connected"
+	}
+
+	values := map[string]string{
+		"wifi_ssid": ssid,
+		"wifi_ip":   ip,
+	}
+	if q, ok := info.quality(); ok {
+		values["wifi_signal_strength"] = strconv.Itoa(info.rssi)
+		values["wifi_signal_quality"] = strconv.Itoa(q)
+		values["wifi_connection_quality"] = info.connectionQuality()
+	}
+	if info.connected {
+		values["wifi_bssid"] = info.bssid
+		values["wifi_band"] = info.band
+		values["wifi_phy_mode"] = info.phyMode
+		if info.noise != 0 {
+			values["wifi_noise"] = strconv.Itoa(info.noise)
+		}
+		if snr, ok := info.snr(); ok {
+			values["wifi_snr"] = strconv.Itoa(snr)
+		}
+		if info.channel != 0 {
+			values["wifi_channel"] = strconv.Itoa(info.channel)
+		}
+		if info.txRate != 0 {
+			values["wifi_tx_rate"] = strconv.FormatFloat(info.txRate, 'f', -1, 64)
+		}
+	}
+
+	for _, topic := range []string{"wifi_ssid", "wifi_signal_strength", "wifi_signal_quality", "wifi_connection_quality", "wifi_ip", "wifi_bssid", "wifi_noise", "wifi_snr", "wifi_channel", "wifi_band", "wifi_phy_mode", "wifi_tx_rate"} {
+		value, ok := values[topic]
+		if !ok || value == "" {
+			// Home Assistant shows "None" as unknown
+			value = "None"
+		}
+		token := publishMQTT(client, prefix+"/status/"+topic, 0, false, value)
+		token.Wait()
+	}
+}
+
+// wifiEventsScript prints "link", "ssid" or "bssid" for every CoreWLAN change of the
+// Wi-Fi link. It exits when stdin is closed, so it does not outlive mac2mqtt.
+const wifiEventsScript = `
+import CoreWLAN
+import Foundation
+
+setvbuf(stdout, nil, _IOLBF, 0)
+
+class Monitor: NSObject, CWEventDelegate {
+    func linkDidChangeForWiFiInterface(withName interfaceName: String) { print("link") }
+    func ssidDidChangeForWiFiInterface(withName interfaceName: String) { print("ssid") }
+    func bssidDidChangeForWiFiInterface(withName interfaceName: String) { print("bssid") }
+}
+
+let monitor = Monitor()
+let client = CWWiFiClient.shared()
+client.delegate = monitor
+do {
+    try client.startMonitoringEvent(with: .linkDidChange)
+    try client.startMonitoringEvent(with: .ssidDidChange)
+    try client.startMonitoringEvent(with: .bssidDidChange)
+} catch {
+    FileHandle.standardError.write("\(error)\n".data(using: .utf8)!)
+    exit(1)
+}
+
+DispatchQueue.global().async {
+    while readLine() != nil {}
+    exit(0)
+}
+dispatchMain()
+`
+
+// wifiSettleDelay lets the link settle after an event, so the DHCP address and
+// the signal of the new access point are published instead of the transition
+const wifiSettleDelay = 2 * time.Second
+
+// watchWiFi updates the Wi-Fi sensors on every CoreWLAN link event, so short drops
+// and roams are caught between the regular polls
+func watchWiFi(client mqtt.Client) {
+	changes := make(chan struct{}, 1)
+	go func() {
+		for range changes {
+			time.Sleep(wifiSettleDelay)
+			updateWiFi(client)
+		}
+	}()
+
+	for {
+		err := runSwiftHelper(wifiEventsScript, func(line string) {
+			if line == "bssid" {
+				wifiBSSIDChanged.Store(true)
+			}
+			// A burst of events results in one update
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+		if debugMode {
+			log.Printf("Warning: Wi-Fi event helper exited: %v", err)
+		}
+		time.Sleep(swiftHelperRetryDelay)
+	}
+}
+
+// getWiFiPower reports whether the Wi-Fi radio is on, from
+// `networksetup -getairportpower en0`: "Wi-Fi Power (en0): On"
+func getWiFiPower() (bool, error) {
+	iface := getWiFiInterface()
+	if iface == "" {
+		return false, fmt.Errorf("no Wi-Fi interface found")
+	}
+
+	output, err := tryGetCommandOutput("/usr/sbin/networksetup", "-getairportpower", iface)
+	if err != nil {
+		return false, fmt.Errorf("networksetup -getairportpower %s failed: %w", iface, err)
+	}
+
+	return strings.HasSuffix(strings.TrimSpace(output), ": On"), nil
+}
+
+func setWiFiPower(on bool) error {
+	iface := getWiFiInterface()
+	if iface == "" {
+		return fmt.Errorf("no Wi-Fi interface found")
+	}
+
+	power := "off"
+	if on {
+		power = "on"
+	}
+
+	output, err := exec.Command("/usr/sbin/networksetup", "-setairportpower", iface, power).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("networksetup -setairportpower %s %s failed: %v (%s)", iface, power, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// getBluetoothPower reports whether the Bluetooth controller is on, using blueutil
+func getBluetoothPower() (bool, error) {
+	path := findHelper("blueutil")
+	if path == "" {
+		return false, fmt.Errorf("blueutil not found")
+	}
+
+	output, err := tryGetCommandOutput(path, "--power")
+	if err != nil {
+		return false, fmt.Errorf("blueutil --power failed: %w", err)
+	}
+	return strings.TrimSpace(output) == "1", nil
+}
+
+// setBluetoothPower turns Bluetooth on or off. macOS has no built-in command for it,
+// so this needs blueutil (`brew install blueutil`).
+func setBluetoothPower(on bool) error {
+	path := findHelper("blueutil")
+	if path == "" {
+		return fmt.Errorf("blueutil not found, install it with `brew install blueutil`")
+	}
+
+	state := "0"
+	if on {
+		state = "1"
+	}
+
+	output, err := exec.Command(path, "--power", state).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("blueutil --power %s failed: %v (%s)", state, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// updateRadios publishes whether the Wi-Fi and Bluetooth radios are on. Without
+// blueutil Bluetooth power is read by updateBluetooth from system_profiler instead.
+func updateRadios(client mqtt.Client) {
+	prefix := getTopicPrefix()
+
+	if on, err := getWiFiPower(); err == nil {
+		token := publishMQTT(client, prefix+"/status/wifi_power", 0, false, strconv.FormatBool(on))
+		token.Wait()
+	} else if debugMode {
+		log.Printf("Warning: failed to get Wi-Fi power: %v", err)
+	}
+
+	if findHelper("blueutil") == "" {
+		return
+	}
+
+	if on, err := getBluetoothPower(); err == nil {
+		token := publishMQTT(client, prefix+"/status/bluetooth_power", 0, false, strconv.FormatBool(on))
+		token.Wait()
+	} else if debugMode {
+		log.Printf("Warning: failed to get Bluetooth power: %v", err)
+	}
+}
+
+// bluetoothDevice is a paired Bluetooth device. Battery levels are keyed by part:
+// "main" for keyboards, mice and trackpads, "left", "right" and "case" for AirPods.
+type bluetoothDevice struct {
+	id        string
+	name      string
+	address   string
+	kind      string
+	connected bool
+	battery   map[string]int
+}
+
+// batteryLevel returns the main battery level, or the lowest earbud for AirPods
+func (d bluetoothDevice) batteryLevel() (int, bool) {
+	if level, ok := d.battery["main"]; ok {
+		return level, true
+	}
+
+	level, found := 100, false
+	for _, part := range []string{"left", "right"} {
+		if l, ok := d.battery[part]; ok {
+			found = true
+			if l < level {
+				level = l
+			}
+		}
+	}
+	return level, found
+}
+
+// spBluetoothData is the part of `system_profiler -json SPBluetoothDataType` used here.
+// Devices are lists of single-key objects: [{"Magic Keyboard": {...}}, ...]
+// The controller state is "controller_properties" on macOS 12.3 and later and
+// "local_device_title" before.
+type spBluetoothData struct {
+	SPBluetoothDataType []struct {
+		Controller struct {
+			State string `json:"controller_state"`
+		} `json:"controller_properties"`
+		LocalDevice struct {
+			Power string `json:"general_power"`
+		} `json:"local_device_title"`
+		Connected    []map[string]map[string]interface{} `json:"device_connected"`
+		NotConnected []map[string]map[string]interface{} `json:"device_not_connected"`
+	} `json:"SPBluetoothDataType"`
+}
+
+// bluetoothInfo is the controller state and the paired devices
+type bluetoothInfo struct {
+	power      bool
+	powerKnown bool
+	devices    []bluetoothDevice
+}
+
+func getBluetooth() (bluetoothInfo, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/system_profiler", "-json", "SPBluetoothDataType")
+	if err != nil {
+		return bluetoothInfo{}, fmt.Errorf("system_profiler SPBluetoothDataType failed: %w", err)
+	}
+	return parseBluetooth([]byte(output))
+}
+
+// parseBluetooth parses the controller state, "controller_state": "attrib_on",
+// and the paired devices, e.g. "device_batteryLevelMain": "76%", "device_minorType": "Keyboard"
+func parseBluetooth(data []byte) (bluetoothInfo, error) {
+	var info bluetoothInfo
+
+	var sp spBluetoothData
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return info, err
+	}
+
+	for _, item := range sp.SPBluetoothDataType {
+		state := item.Controller.State
+		if state == "" {
+			state = item.LocalDevice.Power
+		}
+		if state != "" {
+			info.power = state == "attrib_on"
+			info.powerKnown = true
+		}
+	}
+
+	batteryKeys := map[string]string{
+		"device_batteryLevelMain":  "main",
+		"device_batteryLevel":      "main",
+		"device_batteryLevelLeft":  "left",
+		"device_batteryLevelRight": "right",
+		"device_batteryLevelCase":  "case",
+	}
+
+	var devices []bluetoothDevice
+	add := func(list []map[string]map[string]interface{}, connected bool) {
+		for _, entry := range list {
+			for name, props := range entry {
+				d := bluetoothDevice{
+					name:      name,
+					address:   fmt.Sprint(props["device_address"]),
+					kind:      fmt.Sprint(props["device_minorType"]),
+					connected: connected,
+					battery:   make(map[string]int),
+				}
+				if props["device_minorType"] == nil {
+					d.kind = ""
+				}
+				if props["device_address"] == nil {
+					d.address = name
+				}
+				d.id = entitySlug(d.address)
+
+				for key, part := range batteryKeys {
+					if value, ok := props[key].(string); ok {
+						if level, err := strconv.Atoi(strings.TrimSuffix(value, "%")); err == nil {
+							d.battery[part] = level
+						}
+					}
+				}
+				devices = append(devices, d)
+			}
+		}
+	}
+
+	for _, item := range sp.SPBluetoothDataType {
+		add(item.Connected, true)
+		add(item.NotConnected, false)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].name < devices[j].name })
+	info.devices = devices
+	return info, nil
+}
+
+// bluetoothEntities records which entities were announced for a device
+type bluetoothEntities struct {
+	name    string
+	battery bool
+}
+
+// bluetoothState caches the devices last announced to Home Assistant
+type bluetoothState struct {
+	devices   map[string]bluetoothEntities
+	published bool
+	mu        sync.Mutex
+}
+
+var bluetooth = &bluetoothState{devices: make(map[string]bluetoothEntities)}
+
+func (s *bluetoothState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
+}
+
+// store saves the devices and returns the ids of devices that were unpaired,
+// and the devices whose entities need (re)publishing. A battery sensor is
+// added the first time a device reports its battery level.
+func (s *bluetoothState) store(devices []bluetoothDevice) (removed []string, added []bluetoothDevice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := make(map[string]bluetoothEntities)
+	for _, d := range devices {
+		_, hasBattery := d.batteryLevel()
+		previous, known := s.devices[d.id]
+
+		entities := bluetoothEntities{name: d.name, battery: hasBattery || previous.battery}
+		if !s.published || !known || previous != entities {
+			added = append(added, d)
+		}
+		current[d.id] = entities
+	}
+
+	for id := range s.devices {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+
+	s.devices = current
+	s.published = true
+	return removed, added
+}
+
+func (s *bluetoothState) hasBattery(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[id].battery
+}
+
+func publishBluetoothDeviceEntities(client mqtt.Client, d bluetoothDevice, withBattery bool) {
+	prefix := getTopicPrefix()
+	device := getDeviceInfo()
+	id := "bluetooth_" + d.id
+
+	connectedConfig := map[string]interface{}{
+		"name":                  d.name,
+		"unique_id":             "mac2mqtt_" + hostname + "_" + id + "_connected",
+		"state_topic":           prefix + "/status/" + id + "_connected",
+		"json_attributes_topic": prefix + "/status/" + id + "_attributes",
+		"payload_on":            "true",
+		"payload_off":           "false",
+		"device_class":          "connectivity",
+		"icon":                  "mdi:bluetooth-connect",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "binary_sensor", hostname+"_"+id+"_connected", connectedConfig)
+
+	if !withBattery {
+		return
+	}
+
+	batteryConfig := map[string]interface{}{
+		"name":                  d.name + " Battery",
+		"unique_id":             "mac2mqtt_" + hostname + "_" + id + "_battery",
+		"state_topic":           prefix + "/status/" + id + "_battery",
+		"json_attributes_topic": prefix + "/status/" + id + "_attributes",
+		"unit_of_measurement":   "%",
+		"device_class":          "battery",
+		"state_class":           "measurement",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                device,
+	}
+	publishConfig(client, "sensor", hostname+"_"+id+"_battery", batteryConfig)
+}
+
+func updateBluetooth(client mqtt.Client) {
+	info, err := getBluetooth()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get Bluetooth devices: %v", err)
+		}
+		return
+	}
+	devices := info.devices
+
+	prefix := getTopicPrefix()
+
+	// With blueutil, updateRadios publishes the power state for the switch
+	if info.powerKnown && findHelper("blueutil") == "" {
+		token := publishMQTT(client, prefix+"/status/bluetooth_power", 0, false, strconv.FormatBool(info.power))
+		token.Wait()
+	}
+
+	removed, added := bluetooth.store(devices)
+	for _, id := range removed {
+		removeConfig(client, "binary_sensor", hostname+"_bluetooth_"+id+"_connected")
+		removeConfig(client, "sensor", hostname+"_bluetooth_"+id+"_battery")
+	}
+	for _, d := range added {
+		publishBluetoothDeviceEntities(client, d, bluetooth.hasBattery(d.id))
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		publishCapabilities(client)
+	}
+
+	var connected []map[string]interface{}
+	for _, d := range devices {
+		id := "bluetooth_" + d.id
+
+		attributes := map[string]interface{}{
+			"name":    d.name,
+			"type":    d.kind,
+			"address": d.address,
+		}
+		for part, level := range d.battery {
+			attributes["battery_"+part] = level
+		}
+		if d.connected {
+			connected = append(connected, attributes)
+		}
+
+		data, _ := json.Marshal(attributes)
+		token := publishMQTT(client, prefix+"/status/"+id+"_attributes", 0, false, string(data))
+		token.Wait()
+
+		token = publishMQTT(client, prefix+"/status/"+id+"_connected", 0, false, strconv.FormatBool(d.connected))
+		token.Wait()
+
+		if bluetooth.hasBattery(d.id) {
+			// Battery levels are only reported while connected; show unknown otherwise
+			battery := "None"
+			if level, ok := d.batteryLevel(); ok {
+				battery = strconv.Itoa(level)
+			}
+			token = publishMQTT(client, prefix+"/status/"+id+"_battery", 0, false, battery)
+			token.Wait()
+		}
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"devices": connected})
+	token := publishMQTT(client, prefix+"/status/bluetooth_devices", 0, false, string(data))
+	token.Wait()
+
+	token = publishMQTT(client, prefix+"/status/bluetooth_connected_count", 0, false, strconv.Itoa(len(connected)))
+	token.Wait()
+}
+
+func getAirportInfo() string {
+	path := findAirportPath()
+	if path == "" {
+		return ""
+	}
+
+	cmd := exec.Command(path, "-I")
+	stdout, err := cmd.Output()
+	if err == nil {
+		return strings.TrimSuffix(string(stdout), "\n")
+	}
+
+	log.Printf("Warning: failed to run %s: %v", path, err)
+	return ""
+}
+
+// printLocationServicesInstructions provides guidance on SSID limitations
+func printLocationServicesInstructions() {
+	log.Println("╔══════════════════════════════════════════════════════════════════════════╗")
+	log.Println("║ Wi-Fi SSID is unavailable due to macOS privacy restrictions             ║")
+	log.Println("║                                                                          ║")
+	log.Println("║ Modern macOS (Ventura+) requires bundled applications with proper       ║")
+	log.Println("║ entitlements and Location Services permission to access Wi-Fi SSID.     ║")
+	log.Println("║ Command-line tools like mac2mqtt cannot satisfy these requirements.     ║")
+	log.Println("║                                                                          ║")
+	log.Println("║ Available Wi-Fi metrics without SSID:                                   ║")
+	log.Println("║ • Signal Strength (RSSI)                                                ║")
+	log.Println("║ • IP Address                                                            ║")
+	log.Println("║                                                                          ║")
+	log.Println("║ The SSID sensor will display 'Not Connected' in Home Assistant          ║")
+	log.Println("╚══════════════════════════════════════════════════════════════════════════╝")
+}
+
+// CoreWLAN via swift backs off after a failure, as compiling the script takes seconds and
+// it usually fails the same way (no Xcode tools or no permission). The wait doubles with
+// every failure, from swiftWiFiMinBackoff up to swiftWiFiMaxBackoff.
+const (
+	swiftWiFiMinBackoff = 1 * time.Minute
+	swiftWiFiMaxBackoff = 1 * time.Hour
+)
+
+var (
+	swiftWiFiUnavailable atomic.Bool
+	swiftWiFiRetryAt     atomic.Int64 // UnixNano
+	swiftWiFiBackoff     atomic.Int64 // Duration of the current wait
+)
+
+// swiftWiFiFailed starts or doubles the wait before the next swift attempt
+func swiftWiFiFailed() {
+	backoff := time.Duration(swiftWiFiBackoff.Load()) * 2
+	if backoff < swiftWiFiMinBackoff {
+		backoff = swiftWiFiMinBackoff
+	}
+	if backoff > swiftWiFiMaxBackoff {
+		backoff = swiftWiFiMaxBackoff
+	}
+	swiftWiFiBackoff.Store(int64(backoff))
+	swiftWiFiRetryAt.Store(time.Now().Add(backoff).UnixNano())
+	swiftWiFiUnavailable.Store(true)
+}
+
+// getWiFiInfoViaSwift uses CoreWLAN via the Swift interpreter to fetch the link details,
+// printed in the same format as `airport -I`
+func getWiFiInfoViaSwift() (string, bool) {
+	if swiftWiFiUnavailable.Load() && time.Now().UnixNano() < swiftWiFiRetryAt.Load() {
+		return "", false
+	}
+
+	script := `
+import CoreWLAN
+let phyModes = ["", "802.11a", "802.11b", "802.11g", "802.11n", "802.11ac", "802.11ax"]
+let bands = ["", "2.4 GHz", "5 GHz", "6 GHz"]
+if let iface = CWWiFiClient.shared().interface() {
+    if let ssid = iface.ssid() {
+        print("SSID: \(ssid)")
+    }
+    if let bssid = iface.bssid() {
+        print("BSSID: \(bssid)")
+    }
+    print("agrCtlRSSI: \(iface.rssiValue())")
+    print("agrCtlNoise: \(iface.noiseMeasurement())")
+    print("lastTxRate: \(iface.transmitRate())")
+    if let channel = iface.wlanChannel() {
+        print("channel: \(channel.channelNumber)")
+        let band = channel.channelBand.rawValue
+        if band < bands.count {
+            print("band: \(bands[band])")
+        }
+    }
+    let mode = iface.activePHYMode().rawValue
+    if mode < phyModes.count {
+        print("phyMode: \(phyModes[mode])")
+    }
+}
+`
+	cmd := exec.Command("/usr/bin/swift", "-e", script)
+
+	cacheDir := getSwiftCacheDir()
+	env := os.Environ()
+	if cacheDir != "" {
+		env = append(env, "SWIFT_MODULE_CACHE_PATH="+cacheDir)
+		env = append(env, "CLANG_MODULE_CACHE_PATH="+cacheDir)
+	}
+	cmd.Env = env
+
+	stdout, err := cmd.CombinedOutput()
+	if err != nil || !regexp.MustCompile(`(?m)^SSID:`).Match(stdout) {
+		if debugMode {
+			log.Printf("Warning: swift CoreWLAN Wi-Fi info failed: %v (%s)", err, strings.TrimSpace(string(stdout)))
+		}
+		swiftWiFiFailed()
+		return "", false
+	}
+
+	swiftWiFiUnavailable.Store(false)
+	swiftWiFiBackoff.Store(0)
+	return string(stdout), true
+}
+
+var swiftCacheDir string
+var swiftCacheOnce sync.Once
+
+func getSwiftCacheDir() string {
+	swiftCacheOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "mac2mqtt-swiftcache")
+		if err != nil {
+			if debugMode {
+				log.Printf("Warning: unable to create Swift cache dir: %v", err)
+			}
+			swiftCacheDir = ""
+			return
+		}
+		swiftCacheDir = dir
+	})
+	return swiftCacheDir
+}
+
+var wifiInterface string
+var wifiInterfaceMu sync.Mutex
+
+// getWiFiInterface returns the device name (enX) of the Wi-Fi interface.
+// The lookup is cached, as the hardware ports do not change while running.
+func getWiFiInterface() string {
+	wifiInterfaceMu.Lock()
+	defer wifiInterfaceMu.Unlock()
+
+	if wifiInterface != "" {
+		return wifiInterface
+	}
+
+	cmd := exec.Command("/usr/sbin/networksetup", "-listallhardwareports")
+	stdout, err := cmd.CombinedOutput()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to list hardware ports: %v", err)
+		}
+	}
+	if len(stdout) == 0 {
+		return ""
+	}
+
+	lines := strings.Split(string(stdout), "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "Hardware Port: Wi-Fi") || strings.HasPrefix(lines[i], "Hardware Port: AirPort") {
+			// Next line should be "Device: enX"
+			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "Device: ") {
+				wifiInterface = strings.TrimSpace(strings.TrimPrefix(lines[i+1], "Device: "))
+				return wifiInterface
+			}
+		}
+	}
+
+	// Fallback to en0 if detection fails
+	return "en0"
+}
+
+var airportPath string
+var airportPathOnce sync.Once
+
+func findAirportPath() string {
+	airportPathOnce.Do(func() {
+		candidates := []string{
+			"/System/Library/PrivateFrameworks/Apple80211.framework/Versions/Current/Resources/airport",
+			"/System/Library/PrivateFrameworks/Apple80211.framework/Versions/A/Resources/airport",
+		}
+
+		// Add any other versioned airport binaries if present (e.g., B, C, etc.)
+		if matches, err := filepath.Glob("/System/Library/PrivateFrameworks/Apple80211.framework/Versions/*/Resources/airport"); err == nil {
+			candidates = append(candidates, matches...)
+		}
+
+		for _, p := range candidates {
+			if _, err := os.Stat(p); err == nil {
+				airportPath = p
+				return
+			}
+		}
+		airportPath = ""
+	})
+
+	return airportPath
+}
+
+// interfaceCounters holds the cumulative counters of one network interface
+type interfaceCounters struct {
+	packetsIn  uint64
+	errorsIn   uint64
+	bytesIn    uint64
+	packetsOut uint64
+	errorsOut  uint64
+	bytesOut   uint64
+}
+
+// interfaceRates holds per-second rates of one network interface
+type interfaceRates struct {
+	download   float64 // bytes per second
+	upload     float64 // bytes per second
+	packetsIn  float64
+	packetsOut float64
+	errorsIn   float64
+	errorsOut  float64
+}
+
+// parseNetstat parses the link-level rows of `netstat -ibn` into counters per interface:
+//
+// Name  Mtu   Network       Address            Ipkts Ierrs     Ibytes    Opkts Oerrs     Obytes  Coll
+// en0   1500  <Link#11>   aa:bb:cc:dd:ee:ff  1234567     0 1234567890   765432     0  987654321     0
+// lo0   16384 <Link#1>                         12345     0    2345678    12345     0    2345678     0
+func parseNetstat(output string) map[string]interfaceCounters {
+	counters := make(map[string]interfaceCounters)
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || !strings.HasPrefix(fields[2], "<Link#") {
+			continue
+		}
+
+		// Interfaces without a hardware address (lo0, utunN) have no Address column
+		values := fields[len(fields)-7:]
+		if len(fields) == 10 {
+			values = fields[3:]
+		}
+
+		var n [6]uint64
+		ok := true
+		for i := range n {
+			v, err := strconv.ParseUint(values[i], 10, 64)
+			if err != nil {
+				ok = false
+				break
+			}
+			n[i] = v
+		}
+		if !ok {
+			continue
+		}
+
+		// Interfaces that are down are suffixed with *
+		name := strings.TrimSuffix(fields[0], "*")
+		if _, seen := counters[name]; seen {
+			continue
+		}
+		counters[name] = interfaceCounters{
+			packetsIn:  n[0],
+			errorsIn:   n[1],
+			bytesIn:    n[2],
+			packetsOut: n[3],
+			errorsOut:  n[4],
+			bytesOut:   n[5],
+		}
+	}
+
+	return counters
+}
+
+func getInterfaceCounters() (map[string]interfaceCounters, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/netstat", "-ibn")
+	if err != nil {
+		return nil, fmt.Errorf("failed to run netstat: %w", err)
+	}
+	return parseNetstat(output), nil
+}
+
+// getPrimaryInterface returns the interface carrying the default route, e.g. en0 for
+// Wi-Fi or en5 for a Thunderbolt dock, falling back to the Wi-Fi interface
+func getPrimaryInterface() string {
+	route, err := getDefaultRoute("-inet")
+	if err == nil && route.iface != "" {
+		return route.iface
+	}
+
+	if debugMode {
+		log.Printf("Warning: failed to get default route interface, falling back to Wi-Fi: %v", err)
+	}
+	return getWiFiInterface()
+}
+
+// counterDelta returns how much a counter grew. After a reset (the interface was
+// recreated, e.g. a dock was replugged) the counter itself is the growth since the reset.
+func counterDelta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+func ratesBetween(prev, cur interfaceCounters, seconds float64) interfaceRates {
+	rate := func(prev, cur uint64) float64 {
+		return float64(counterDelta(prev, cur)) / seconds
+	}
+
+	return interfaceRates{
+		download:   rate(prev.bytesIn, cur.bytesIn),
+		upload:     rate(prev.bytesOut, cur.bytesOut),
+		packetsIn:  rate(prev.packetsIn, cur.packetsIn),
+		packetsOut: rate(prev.packetsOut, cur.packetsOut),
+		errorsIn:   rate(prev.errorsIn, cur.errorsIn),
+		errorsOut:  rate(prev.errorsOut, cur.errorsOut),
+	}
+}
+
+// updateNetworkStats samples all interfaces and calculates rates since the previous sample
+func updateNetworkStats() {
+	counters, err := getInterfaceCounters()
+	primary := getPrimaryInterface()
+
+	netStats.mu.Lock()
+	defer netStats.mu.Unlock()
+
+	netStats.primary = primary
+
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get network stats: %v", err)
+		}
+		// Reset rates on error
+		netStats.rates = nil
+		netStats.history = nil
+		return
+	}
+
+	now := time.Now()
+	seconds := now.Sub(netStats.timestamp).Seconds()
+
+	rates := make(map[string]interfaceRates)
+	history := make(map[string][]interfaceRates)
+	if !netStats.timestamp.IsZero() && seconds > 0 {
+		for name, cur := range counters {
+			if prev, ok := netStats.counters[name]; ok {
+				samples := append(netStats.history[name], ratesBetween(prev, cur, seconds))
+				if len(samples) > networkSmoothing {
+					samples = samples[len(samples)-networkSmoothing:]
+				}
+				history[name] = samples
+				rates[name] = averageRates(samples)
+			}
+		}
+	}
+
+	// Traffic totals follow the primary interface, like the rates, and survive restarts
+	if prev, ok := netStats.counters[primary]; ok {
+		if cur, ok := counters[primary]; ok {
+			state.addNetworkBytes(counterDelta(prev.bytesIn, cur.bytesIn), counterDelta(prev.bytesOut, cur.bytesOut))
+		}
+	}
+
+	netStats.counters = counters
+	netStats.rates = rates
+	netStats.history = history
+	netStats.timestamp = now
+}
+
+// averageRates returns the moving average of the samples
+func averageRates(samples []interfaceRates) interfaceRates {
+	var avg interfaceRates
+	for _, r := range samples {
+		avg.download += r.download
+		avg.upload += r.upload
+		avg.packetsIn += r.packetsIn
+		avg.packetsOut += r.packetsOut
+		avg.errorsIn += r.errorsIn
+		avg.errorsOut += r.errorsOut
+	}
+
+	n := float64(len(samples))
+	return interfaceRates{
+		download:   avg.download / n,
+		upload:     avg.upload / n,
+		packetsIn:  avg.packetsIn / n,
+		packetsOut: avg.packetsOut / n,
+		errorsIn:   avg.errorsIn / n,
+		errorsOut:  avg.errorsOut / n,
+	}
+}
+
+// networkRateUnit is a unit the upload and download rates can be published in
+type networkRateUnit struct {
+	name      string  // unit_of_measurement
+	divisor   float64 // Bytes per second in one unit
+	precision int
+	dataRate  bool // name is a Home Assistant data_rate unit
+}
+
+// networkRateUnits maps the network_rate_unit setting to its unit. Every setting is
+// published as the Home Assistant data_rate unit of the same name: kB/s and MB/s are
+// decimal, KiB/s and MiB/s binary. The one exception is the default KB/s, which stays
+// binary and without a device class as it always was, so the long-term statistics of
+// existing installations keep their unit.
+var networkRateUnits = map[string]networkRateUnit{
+	"B/s":    {"B/s", 1, 0, true},
+	"KB/s":   {"KB/s", 1024, 2, false},
+	"kB/s":   {"kB/s", 1000, 2, true},
+	"MB/s":   {"MB/s", 1000 * 1000, 2, true},
+	"KiB/s":  {"KiB/s", 1024, 2, true},
+	"MiB/s":  {"MiB/s", 1024 * 1024, 2, true},
+	"kbit/s": {"kbit/s", 1000.0 / 8, 1, true},
+	"Mbit/s": {"Mbit/s", 1000000.0 / 8, 2, true},
+}
+
+// networkRateEntity is a rate published for the primary interface
+// and, with network_per_interface, for every active interface
+type networkRateEntity struct {
+	id        string
+	name      string
+	unit      string // Empty for byte rates, which use network_rate_unit
+	icon      string
+	precision int
+	value     func(r interfaceRates) float64
+}
+
+var networkRateEntities = []networkRateEntity{
+	{"upload_rate", "Upload", "", "mdi:upload", 0, func(r interfaceRates) float64 { return r.upload }},
+	{"download_rate", "Download", "", "mdi:download", 0, func(r interfaceRates) float64 { return r.download }},
+	{"packets_in_rate", "Packets In", "packets/s", "mdi:download-network", 1, func(r interfaceRates) float64 { return r.packetsIn }},
+	{"packets_out_rate", "Packets Out", "packets/s", "mdi:upload-network", 1, func(r interfaceRates) float64 { return r.packetsOut }},
+	{"errors_in_rate", "Errors In", "errors/s", "mdi:alert-circle-outline", 2, func(r interfaceRates) float64 { return r.errorsIn }},
+	{"errors_out_rate", "Errors Out", "errors/s", "mdi:alert-circle-outline", 2, func(r interfaceRates) float64 { return r.errorsOut }},
+}
+
+func (e networkRateEntity) isDataRate() bool {
+	return e.unit == ""
+}
+
+// format returns the rate in the entity's unit
+func (e networkRateEntity) format(r interfaceRates) string {
+	if e.isDataRate() {
+		return strconv.FormatFloat(e.value(r)/networkRate.divisor, 'f', networkRate.precision, 64)
+	}
+	return strconv.FormatFloat(e.value(r), 'f', e.precision, 64)
+}
+
+// publishNetworkRateSensors publishes discovery for the rate sensors of one
+// interface, or of the primary interface when iface is empty
+func publishNetworkRateSensors(client mqtt.Client, iface string) {
+	prefix := getTopicPrefix()
+	device := getDeviceInfo()
+
+	for _, e := range networkRateEntities {
+		id, name := networkEntityID(iface, e.id), "Network "+e.name
+		if iface != "" {
+			name = "Network " + iface + " " + e.name
+		}
+
+		rateConfig := map[string]interface{}{
+			"name":                        name,
+			"unique_id":                   "mac2mqtt_" + hostname + "_" + id,
+			"state_topic":                 prefix + "/status/" + id,
+			"unit_of_measurement":         e.unit,
+			"icon":                        e.icon,
+			"state_class":                 "measurement",
+			"suggested_display_precision": e.precision,
+			"availability_topic":          prefix + "/status/alive",
+			"payload_available":           "true",
+			"payload_not_available":       "false",
+			"device":                      device,
+		}
+		if e.isDataRate() {
+			rateConfig["unit_of_measurement"] = networkRate.name
+			rateConfig["suggested_display_precision"] = networkRate.precision
+			if networkRate.dataRate {
+				rateConfig["device_class"] = "data_rate"
+				rateConfig["suggested_unit_of_measurement"] = networkRate.name
+			}
+		}
+		publishConfig(client, "sensor", hostname+"_"+id, rateConfig)
+	}
+}
+
+// networkEntityID returns e.g. network_upload_rate for the primary interface
+// and network_en5_upload_rate for a specific one
+func networkEntityID(iface, id string) string {
+	if iface == "" {
+		return "network_" + id
+	}
+	return "network_" + entitySlug(iface) + "_" + id
+}
+
+// networkInterfaceState caches the interfaces that have per-interface sensors
+type networkInterfaceState struct {
+	names     map[string]bool
+	published bool
+	mu        sync.Mutex
+}
+
+var netInterfaces = &networkInterfaceState{names: make(map[string]bool)}
+
+func (s *networkInterfaceState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
+}
+
+// store saves the active interfaces and returns the ones that disappeared,
+// and the ones whose sensors need (re)publishing
+func (s *networkInterfaceState) store(names []string) (removed, added []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := make(map[string]bool)
+	for _, name := range names {
+		current[name] = true
+		if !s.names[name] || !s.published {
+			added = append(added, name)
+		}
+	}
+	for name := range s.names {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	s.names = current
+	s.published = true
+	return removed, added
+}
+
+// activeInterfaces returns the interfaces that have carried traffic, except loopback
+func activeInterfaces(counters map[string]interfaceCounters) []string {
+	var names []string
+	for name, c := range counters {
+		if strings.HasPrefix(name, "lo") || (c.bytesIn == 0 && c.bytesOut == 0) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func publishNetworkRates(client mqtt.Client, iface string, r interfaceRates) {
+	prefix := getTopicPrefix()
+	for _, e := range networkRateEntities {
+		token := publishMQTT(client, prefix+"/status/"+networkEntityID(iface, e.id), 0, false, e.format(r))
+		token.Wait()
+	}
+}
+
+// updateNetworkActivity publishes network activity to MQTT
+func updateNetworkActivity(client mqtt.Client) {
+	// First update the stats
+	updateNetworkStats()
+
+	netStats.mu.Lock()
+	primary := netStats.primary
+	rates := netStats.rates
+	interfaces := activeInterfaces(netStats.counters)
+	netStats.mu.Unlock()
+
+	// Then publish the rates
+	publishNetworkRates(client, "", rates[primary])
+
+	prefix := getTopicPrefix()
+	received, sent := state.networkBytes()
+
+	token := publishMQTT(client, prefix+"/status/network_bytes_received", 0, false, strconv.FormatUint(received, 10))
+	token.Wait()
+
+	token = publishMQTT(client, prefix+"/status/network_bytes_sent", 0, false, strconv.FormatUint(sent, 10))
+	token.Wait()
+
+	if !networkPerInterface {
+		return
+	}
+
+	removed, added := netInterfaces.store(interfaces)
+	for _, name := range removed {
+		for _, e := range networkRateEntities {
+			removeConfig(client, "sensor", hostname+"_"+networkEntityID(name, e.id))
+		}
+	}
+	for _, name := range added {
+		publishNetworkRateSensors(client, name)
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		publishCapabilities(client)
+	}
+
+	for _, name := range interfaces {
+		publishNetworkRates(client, name, rates[name])
+	}
+}
+
+// defaultRoute is the interface and gateway of the default route
+type defaultRoute struct {
+	iface   string
+	gateway string
+}
+
+// parseRouteGet parses `route -n get default`, e.g.
+//
+//	gateway: 192.168.1.1
+//	interface: en0
+func parseRouteGet(output string) defaultRoute {
+	var r defaultRoute
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "interface":
+			r.iface = strings.TrimSpace(value)
+		case "gateway":
+			r.gateway = strings.TrimSpace(value)
+		}
+	}
+	return r
+}
+
+func getDefaultRoute(family string) (defaultRoute, error) {
+	output, err := tryGetCommandOutput("/sbin/route", "-n", "get", family, "default")
+	if err != nil {
+		return defaultRoute{}, err
+	}
+	return parseRouteGet(output), nil
+}
+
+// networkInfo describes how the Mac is connected: the primary interface and
+// its addresses, gateways and DNS configuration
+type networkInfo struct {
+	Interface     string   `json:"interface"`
+	Service       string   `json:"service"`
+	IPv4          []string `json:"ipv4"`
+	IPv6          []string `json:"ipv6"`
+	Gateway       string   `json:"gateway"`
+	GatewayIPv6   string   `json:"gateway_ipv6"`
+	DNSServers    []string `json:"dns_servers"`
+	SearchDomains []string `json:"search_domains"`
+}
+
+// key identifies the network the Mac is on, to detect moves between networks
+func (n networkInfo) key() string {
+	return n.Interface + "|" + n.Gateway + "|" + strings.Join(n.IPv4, ",")
+}
+
+// parseIfconfigAddresses returns the IPv4 and IPv6 addresses from `ifconfig IFACE`,
+// skipping link-local IPv6 addresses:
+//
+//	inet 192.168.1.10 netmask 0xffffff00 broadcast 192.168.1.255
+//	inet6 fe80::1c2b:3a4d:5e6f:7a8b%en0 prefixlen 64 secured scopeid 0xb
+//	inet6 2001:db8::1c2b:3a4d:5e6f:7a8b prefixlen 64 autoconf secured
+func parseIfconfigAddresses(output string) (ipv4, ipv6 []string) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "inet":
+			ipv4 = append(ipv4, fields[1])
+		case "inet6":
+			if !strings.HasPrefix(strings.ToLower(fields[1]), "fe80:") {
+				ipv6 = append(ipv6, fields[1])
+			}
+		}
+	}
+	return ipv4, ipv6
+}
+
+// parseScutilDNS returns the name servers and search domains of the default
+// resolvers in `scutil --dns`. Resolvers for a specific domain (e.g. "local"
+// for mDNS) and the scoped section at the end are skipped.
+//
+//	resolver #1
+//	  search domain[0] : lan
+//	  nameserver[0] : 192.168.1.1
+func parseScutilDNS(output string) (servers, domains []string) {
+	add := func(list []string, value string) []string {
+		for _, v := range list {
+			if v == value {
+				return list
+			}
+		}
+		return append(list, value)
+	}
+
+	// Split into resolver blocks, ignoring the scoped queries section
+	output, _, _ = strings.Cut(output, "DNS configuration (for scoped queries)")
+	for _, block := range strings.Split(output, "resolver #")[1:] {
+		if regexp.MustCompile(`(?m)^\s*domain\s+:`).MatchString(block) {
+			continue
+		}
+		for _, line := range strings.Split(block, "\n") {
+			key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+			if !ok {
+				continue
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			switch {
+			case strings.HasPrefix(key, "nameserver["):
+				servers = add(servers, value)
+			case strings.HasPrefix(key, "search domain["):
+				domains = add(domains, value)
+			}
+		}
+	}
+
+	return servers, domains
+}
+
+// parseServiceOrder maps devices to network service names from
+// `networksetup -listnetworkserviceorder`:
+//
+//	(1) Wi-Fi
+//	(Hardware Port: Wi-Fi, Device: en0)
+func parseServiceOrder(output string) map[string]string {
+	services := make(map[string]string)
+
+	r := regexp.MustCompile(`(?m)^\(\d+\) (.+)\n\(Hardware Port: .*, Device: (\w+)\)`)
+	for _, m := range r.FindAllStringSubmatch(output, -1) {
+		services[m[2]] = strings.TrimSpace(m[1])
+	}
+
+	return services
+}
+
+func getNetworkInfo() networkInfo {
+	var info networkInfo
+
+	route, err := getDefaultRoute("-inet")
+	if err != nil || route.iface == "" {
+		// No default route: offline
+		return info
+	}
+	info.Interface = route.iface
+	info.Gateway = route.gateway
+
+	if route6, err := getDefaultRoute("-inet6"); err == nil {
+		// Link-local gateways carry a scope suffix, e.g. fe80::1%en0
+		info.GatewayIPv6, _, _ = strings.Cut(route6.gateway, "%")
+	}
+
+	if output, err := tryGetCommandOutput("/sbin/ifconfig", info.Interface); err == nil {
+		info.IPv4, info.IPv6 = parseIfconfigAddresses(output)
+	}
+
+	if output, err := tryGetCommandOutput("/usr/sbin/scutil", "--dns"); err == nil {
+		info.DNSServers, info.SearchDomains = parseScutilDNS(output)
+	}
+
+	if output, err := tryGetCommandOutput("/usr/sbin/networksetup", "-listnetworkserviceorder"); err == nil {
+		info.Service = parseServiceOrder(output)[info.Interface]
+	}
+
+	return info
+}
+
+// lastNetworkInfo remembers the previous network to detect moves
+var lastNetworkInfo struct {
+	info  networkInfo
+	known bool
+	mu    sync.Mutex
+}
+
+// networkInfoEntities are the network info sensors; each shows the full info as attributes.
+// Lists publish their first entry as the state, as Home Assistant rejects states longer
+// than 255 characters, which a few IPv6 addresses or DNS servers already exceed.
+var networkInfoEntities = []struct {
+	id    string
+	name  string
+	icon  string
+	value func(n networkInfo) string
+}{
+	{"network_interface", "Primary Interface", "mdi:lan", func(n networkInfo) string { return n.Interface }},
+	{"network_service", "Primary Service", "mdi:lan-connect", func(n networkInfo) string { return n.Service }},
+	{"network_ipv4", "IPv4 Address", "mdi:ip-network", func(n networkInfo) string { return firstOf(n.IPv4) }},
+	{"network_ipv6", "IPv6 Address", "mdi:ip-network-outline", func(n networkInfo) string { return firstOf(n.IPv6) }},
+	{"network_gateway", "Gateway", "mdi:router-network", func(n networkInfo) string { return n.Gateway }},
+	{"network_dns_servers", "DNS Servers", "mdi:dns", func(n networkInfo) string { return firstOf(n.DNSServers) }},
+	{"network_search_domains", "Search Domains", "mdi:domain", func(n networkInfo) string { return firstOf(n.SearchDomains) }},
+}
+
+// firstOf returns the first entry of a list, or "" for an empty list
+func firstOf(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
+
+func updateNetworkInfo(client mqtt.Client) {
+	info := getNetworkInfo()
+	prefix := getTopicPrefix()
+
+	lastNetworkInfo.mu.Lock()
+	previous, known := lastNetworkInfo.info, lastNetworkInfo.known
+	lastNetworkInfo.info, lastNetworkInfo.known = info, true
+	lastNetworkInfo.mu.Unlock()
+
+	if known && previous.key() != info.key() {
+		eventType := "changed"
+		if previous.Interface == "" {
+			eventType = "connected"
+		} else if info.Interface == "" {
+			eventType = "disconnected"
+		}
+		log.Printf("Network %s: %s (%s) -> %s (%s)", eventType, previous.Interface, previous.Gateway, info.Interface, info.Gateway)
+		publishEvent(client, prefix+"/status/network_event", eventType, map[string]interface{}{
+			"interface":          info.Interface,
+			"service":            info.Service,
+			"ipv4":               info.IPv4,
+			"gateway":            info.Gateway,
+			"previous_interface": previous.Interface,
+			"previous_ipv4":      previous.IPv4,
+			"previous_gateway":   previous.Gateway,
+		})
+	}
+
+	attributes, err := json.Marshal(info)
+	if err != nil {
+		log.Printf("Error marshaling network info: %v", err)
+		return
+	}
+	token := publishMQTT(client, prefix+"/status/network_info", 0, false, string(attributes))
+	token.Wait()
+
+	for _, e := range networkInfoEntities {
+		value := e.value(info)
+		if value == "" {
+			// Home Assistant shows "None" as unknown
+			value = "None"
+		}
+		token := publishMQTT(client, prefix+"/status/"+e.id, 0, false, value)
+		token.Wait()
+	}
+}
+
+// vpnService is a VPN configured in System Settings, from `scutil --nc list`
+type vpnService struct {
+	id      string
+	name    string
+	uuid    string
+	kind    string // e.g. "PPP/L2TP", "IPSec" or "VPN/WireGuard"
+	status  string // e.g. "Connected", "Connecting", "Disconnected"
+	address string // Tunnel IPv4 address while connected
+}
+
+func (v vpnService) connected() bool {
+	return v.status == "Connected"
+}
+
+// parseVPNServices parses `scutil --nc list`:
+//
+//	Available network connection services in the current set (*=enabled):
+//	* (Connected)      8A2E5B2C-...-4E1F PPP --> L2TP       "Work VPN"        [PPP/L2TP]
+//	* (Disconnected)   12AB34CD-...-9A0B VPN (com.wireguard.macos) "Home" [VPN/WireGuard]
+func parseVPNServices(output string) []vpnService {
+	var services []vpnService
+
+	r := regexp.MustCompile(`^\*?\s*\(([^)]+)\)\s+([0-9A-Fa-f-]{36})\s.*?"(.+)"\s+\[(.+)\]`)
+	for _, line := range strings.Split(output, "\n") {
+		m := r.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		// Keyed on the UUID, as names need not be unique and can be renamed
+		services = append(services, vpnService{
+			id:     entitySlug(m[2]),
+			name:   m[3],
+			uuid:   m[2],
+			kind:   m[4],
+			status: m[1],
+		})
+	}
+
+	return services
+}
+
+// parseVPNAddress returns the tunnel address from `scutil --nc status`:
+//
+//	Connected
+//	Extended Status <dictionary> {
+//	  IPv4 : <dictionary> {
+//	    Addresses : <array> {
+//	      0 : 10.8.0.2
+func parseVPNAddress(output string) string {
+	m := regexp.MustCompile(`(?s)IPv4 : <dictionary> \{.*?Addresses : <array> \{\s*0 : (\S+)`).FindStringSubmatch(output)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func getVPNServices() ([]vpnService, error) {
+	output, err := tryGetCommandOutput("/usr/sbin/scutil", "--nc", "list")
+	if err != nil {
+		return nil, fmt.Errorf("scutil --nc list failed: %w", err)
+	}
+
+	services := parseVPNServices(output)
+	for i, v := range services {
+		if !v.connected() {
+			continue
+		}
+		if status, err := tryGetCommandOutput("/usr/sbin/scutil", "--nc", "status", v.uuid); err == nil {
+			services[i].address = parseVPNAddress(status)
+		}
+	}
+
+	return services, nil
+}
+
+// setVPN starts or stops a VPN service by UUID
+func setVPN(uuid string, connect bool) error {
+	action := "stop"
+	if connect {
+		action = "start"
+	}
+
+	output, err := exec.Command("/usr/sbin/scutil", "--nc", action, uuid).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("scutil --nc %s %s failed: %v (%s)", action, uuid, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// handleVPNCommand starts or stops the service from {"service": NAME, "connected": BOOL}.
+// The service is a name as shown in System Settings, or its UUID when names are ambiguous.
+func handleVPNCommand(client mqtt.Client, value interface{}) {
+	var req struct {
+		Service   string `json:"service"`
+		Connected *bool  `json:"connected"`
+	}
+	if err := json.Unmarshal(value.(json.RawMessage), &req); err != nil || req.Connected == nil {
+		log.Println("Incorrect value for command vpn: expected {\"service\": NAME, \"connected\": true/false}")
+		return
+	}
+
+	uuid, err := vpns.lookup(req.Service)
+	if err != nil {
+		log.Printf("Incorrect value for command vpn: %v", err)
+		return
+	}
+
+	if err := setVPN(uuid, *req.Connected); err != nil {
+		log.Printf("Failed to set VPN: %v", err)
+	}
+
+	updateVPN(client)
+}
+
+// vpnState caches the VPN services last announced to Home Assistant
+type vpnState struct {
+	services  []vpnService
+	published bool
+	mu        sync.Mutex
+}
+
+var vpns = &vpnState{}
+
+func (s *vpnState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
+}
+
+// lookup returns the UUID of the service with the given name or UUID
+func (s *vpnState) lookup(service string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []string
+	for _, v := range s.services {
+		if strings.EqualFold(v.uuid, service) {
+			return v.uuid, nil
+		}
+		if v.name == service {
+			matches = append(matches, v.uuid)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("unknown VPN service %q", service)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%d VPN services are named %q, use the UUID instead", len(matches), service)
+}
+
+// store saves the services and returns the ids of services that were deleted,
+// and the services whose binary sensors need (re)publishing
+func (s *vpnState) store(services []vpnService) (removed []string, added []vpnService) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	known := make(map[string]bool)
+	for _, v := range s.services {
+		known[v.id] = true
+	}
+
+	current := make(map[string]bool)
+	for _, v := range services {
+		current[v.id] = true
+		if !s.published || !known[v.id] {
+			added = append(added, v)
+		}
+	}
+	for id := range known {
+		if !current[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	s.services = services
+	s.published = true
+	return removed, added
+}
+
+func publishVPNSensor(client mqtt.Client, v vpnService) {
+	prefix := getTopicPrefix()
+	id := "vpn_" + v.id
+
+	name := v.name
+	if !strings.Contains(strings.ToUpper(name), "VPN") {
+		name += " VPN"
+	}
+
+	vpnConfig := map[string]interface{}{
+		"name":                  name,
+		"unique_id":             "mac2mqtt_" + hostname + "_" + id,
+		"state_topic":           prefix + "/status/" + id,
+		"json_attributes_topic": prefix + "/status/" + id + "_attributes",
+		"payload_on":            "true",
+		"payload_off":           "false",
+		"device_class":          "connectivity",
+		"icon":                  "mdi:vpn",
+		"availability_topic":    prefix + "/status/alive",
+		"payload_available":     "true",
+		"payload_not_available": "false",
+		"device":                getDeviceInfo(),
 	}
+	publishConfig(client, "binary_sensor", hostname+"_"+id, vpnConfig)
+
+	// Earlier versions keyed the entities on the service name, and announced switches
+	oldID := "vpn_" + entitySlug(v.name)
+	removeConfig(client, "binary_sensor", hostname+"_"+oldID)
+	removeConfig(client, "switch", hostname+"_"+oldID)
+}
 
-	// Try ipconfig getsummary which can expose SSID on some macOS versions
-	if ssid, ok := getSSIDFromIpconfig(); ok {
-		return ssid
+func updateVPN(client mqtt.Client) {
+	services, err := getVPNServices()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get VPN services: %v", err)
+		}
+		return
 	}
 
-	// Try CoreWLAN via swift as a robust fallback
-	if ssid, _, ok := getWiFiInfoViaSwift(); ok && ssid != "" {
-		return ssid
+	prefix := getTopicPrefix()
+
+	removed, added := vpns.store(services)
+	for _, id := range removed {
+		removeConfig(client, "binary_sensor", hostname+"_vpn_"+id)
+	}
+	for _, v := range added {
+		publishVPNSensor(client, v)
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		publishCapabilities(client)
 	}
 
-	output := getAirportInfo()
+	var connected []string
+	for _, v := range services {
+		id := "vpn_" + v.id
+		if v.connected() {
+			connected = append(connected, v.name)
+		}
 
-	// Extract SSID from airport output
-	r := regexp.MustCompile(`\s+SSID: (.+)`)
-	matches := r.FindStringSubmatch(output)
-	if len(matches) > 1 {
-		return matches[1]
+		attributes, _ := json.Marshal(map[string]string{
+			"service": v.name,
+			"uuid":    v.uuid,
+			"type":    v.kind,
+			"status":  v.status,
+			"address": v.address,
+		})
+		token := publishMQTT(client, prefix+"/status/"+id+"_attributes", 0, false, string(attributes))
+		token.Wait()
+
+		token = publishMQTT(client, prefix+"/status/"+id, 0, false, strconv.FormatBool(v.connected()))
+		token.Wait()
 	}
 
-	// Log a one-time informational message about SSID restrictions on modern macOS
-	ssidWarningOnce.Do(func() {
-		log.Println("")
-		log.Println("Wi-Fi SSID unavailable - Location Services permission required")
-		printLocationServicesInstructions()
-		log.Println("")
-	})
+	attributes, _ := json.Marshal(map[string]interface{}{"connected_services": connected})
+	token := publishMQTT(client, prefix+"/status/vpn_attributes", 0, false, string(attributes))
+	token.Wait()
 
-	return "Not Connected"
+	token = publishMQTT(client, prefix+"/status/vpn_connected", 0, false, strconv.FormatBool(len(connected) > 0))
+	token.Wait()
 }
 
-func getWiFiSignalStrength() string {
-	output := getAirportInfo()
+// mediaUsage is whether any application uses a camera or a microphone
+type mediaUsage struct {
+	camera     bool
+	microphone bool
+	known      bool // false until the helper reported the first state
+	mu         sync.Mutex
+}
 
-	// Extract RSSI (signal strength) from airport output
-	r := regexp.MustCompile(`\s+agrCtlRSSI: (-?\d+)`)
-	matches := r.FindStringSubmatch(output)
-	if len(matches) > 1 {
-		return matches[1]
+var capture mediaUsage
+
+func (m *mediaUsage) store(camera, microphone bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.camera = camera
+	m.microphone = microphone
+	m.known = true
+}
+
+// forget marks the state unknown, so a stale "in use" does not outlive the helper
+func (m *mediaUsage) forget() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.camera = false
+	m.microphone = false
+	m.known = false
+}
+
+// get returns the camera and microphone state, ok is false while unknown
+func (m *mediaUsage) get() (camera, microphone, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.camera, m.microphone, m.known
+}
+
+// mediaUsageScript listens for kCMIODevicePropertyDeviceIsRunningSomewhere on all
+// cameras and prints "camera=<bool> microphone=<bool>" whenever the combined state
+// changes. The microphone is in use when any process records audio
+// (kAudioProcessPropertyIsRunningInput, macOS 14+), older systems fall back to
+// kAudioDevicePropertyDeviceIsRunningSomewhere in the input scope of input devices.
+// Playback alone never counts, also on headsets that are a single input/output device.
+// It exits when stdin is closed, so it does not outlive mac2mqtt.
+const mediaUsageScript = `
+import CoreAudio
+import CoreMediaIO
+import Foundation
+
+setvbuf(stdout, nil, _IOLBF, 0)
+
+let system = AudioObjectID(kAudioObjectSystemObject)
+var devicesAddr = AudioObjectPropertyAddress(mSelector: kAudioHardwarePropertyDevices, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+var runningAddr = AudioObjectPropertyAddress(mSelector: kAudioDevicePropertyDeviceIsRunningSomewhere, mScope: kAudioObjectPropertyScopeInput, mElement: kAudioObjectPropertyElementMain)
+// kAudioHardwarePropertyProcessObjectList ('prs#') and kAudioProcessPropertyIsRunningInput ('piri'),
+// as raw values so the script also compiles with SDKs older than macOS 14
+var processesAddr = AudioObjectPropertyAddress(mSelector: 0x70727323, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+var processInputAddr = AudioObjectPropertyAddress(mSelector: 0x70697269, mScope: kAudioObjectPropertyScopeGlobal, mElement: kAudioObjectPropertyElementMain)
+var inputStreamsAddr = AudioObjectPropertyAddress(mSelector: kAudioDevicePropertyStreams, mScope: kAudioObjectPropertyScopeInput, mElement: kAudioObjectPropertyElementMain)
+
+let cmioSystem = CMIOObjectID(kCMIOObjectSystemObject)
+var cameraDevicesAddr = CMIOObjectPropertyAddress(mSelector: CMIOObjectPropertySelector(kCMIOHardwarePropertyDevices), mScope: CMIOObjectPropertyScope(kCMIOObjectPropertyScopeGlobal), mElement: 0)
+var cameraRunningAddr = CMIOObjectPropertyAddress(mSelector: CMIOObjectPropertySelector(kCMIODevicePropertyDeviceIsRunningSomewhere), mScope: CMIOObjectPropertyScope(kCMIOObjectPropertyScopeGlobal), mElement: 0)
+
+func microphones() -> [AudioObjectID] {
+    var size: UInt32 = 0
+    AudioObjectGetPropertyDataSize(system, &devicesAddr, 0, nil, &size)
+    var ids = [AudioObjectID](repeating: 0, count: Int(size) / MemoryLayout<AudioObjectID>.size)
+    AudioObjectGetPropertyData(system, &devicesAddr, 0, nil, &size, &ids)
+    return ids.filter { id in
+        var streamsSize: UInt32 = 0
+        return AudioObjectGetPropertyDataSize(id, &inputStreamsAddr, 0, nil, &streamsSize) == noErr && streamsSize > 0
+    }
+}
+
+// processes returns the CoreAudio process objects, nil when the system has no process list
+func processes() -> [AudioObjectID]? {
+    var size: UInt32 = 0
+    if AudioObjectGetPropertyDataSize(system, &processesAddr, 0, nil, &size) != noErr {
+        return nil
+    }
+    var ids = [AudioObjectID](repeating: 0, count: Int(size) / MemoryLayout<AudioObjectID>.size)
+    if AudioObjectGetPropertyData(system, &processesAddr, 0, nil, &size, &ids) != noErr {
+        return nil
+    }
+    return ids
+}
+let perProcess = processes() != nil
+
+func cameras() -> [CMIOObjectID] {
+    var size: UInt32 = 0
+    CMIOObjectGetPropertyDataSize(cmioSystem, &cameraDevicesAddr, 0, nil, &size)
+    var ids = [CMIOObjectID](repeating: 0, count: Int(size) / MemoryLayout<CMIOObjectID>.size)
+    var used: UInt32 = 0
+    CMIOObjectGetPropertyData(cmioSystem, &cameraDevicesAddr, 0, nil, size, &used, &ids)
+    return ids
+}
+
+func microphoneInUse() -> Bool {
+    if perProcess {
+        for id in processes() ?? [] {
+            var running: UInt32 = 0
+            var size = UInt32(MemoryLayout<UInt32>.size)
+            if AudioObjectGetPropertyData(id, &processInputAddr, 0, nil, &size, &running) == noErr && running != 0 {
+                return true
+            }
+        }
+        return false
+    }
+    for id in microphones() {
+        var running: UInt32 = 0
+        var size = UInt32(MemoryLayout<UInt32>.size)
+        if AudioObjectGetPropertyData(id, &runningAddr, 0, nil, &size, &running) == noErr && running != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+func cameraInUse() -> Bool {
+    for id in cameras() {
+        var running: UInt32 = 0
+        var used: UInt32 = 0
+        if CMIOObjectGetPropertyData(id, &cameraRunningAddr, 0, nil, UInt32(MemoryLayout<UInt32>.size), &used, &running) == noErr && running != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+var last = ""
+func report() {
+    let line = "camera=\(cameraInUse()) microphone=\(microphoneInUse())"
+    if line != last {
+        print(line)
+        last = line
+    }
+}
+
+var watchedMicrophones = Set<AudioObjectID>()
+var watchedProcesses = Set<AudioObjectID>()
+var watchedCameras = Set<CMIOObjectID>()
+func watch() {
+    if perProcess {
+        for id in processes() ?? [] where !watchedProcesses.contains(id) {
+            AudioObjectAddPropertyListenerBlock(id, &processInputAddr, DispatchQueue.main) { _, _ in report() }
+            watchedProcesses.insert(id)
+        }
+    } else {
+        for id in microphones() where !watchedMicrophones.contains(id) {
+            AudioObjectAddPropertyListenerBlock(id, &runningAddr, DispatchQueue.main) { _, _ in report() }
+            watchedMicrophones.insert(id)
+        }
+    }
+    for id in cameras() where !watchedCameras.contains(id) {
+        CMIOObjectAddPropertyListenerBlock(id, &cameraRunningAddr, DispatchQueue.main) { _, _ in report() }
+        watchedCameras.insert(id)
+    }
+    report()
+}
+
+AudioObjectAddPropertyListenerBlock(system, &devicesAddr, DispatchQueue.main) { _, _ in watch() }
+if perProcess {
+    AudioObjectAddPropertyListenerBlock(system, &processesAddr, DispatchQueue.main) { _, _ in watch() }
+}
+CMIOObjectAddPropertyListenerBlock(cmioSystem, &cameraDevicesAddr, DispatchQueue.main) { _, _ in watch() }
+watch()
+
+DispatchQueue.global().async {
+    while readLine() != nil {}
+    exit(0)
+}
+dispatchMain()
+`
+
+// swiftHelperRetryDelay is the wait before a helper is started again after it exited
+const swiftHelperRetryDelay = 1 * time.Minute
+
+// parseMediaUsage parses a "camera=<bool> microphone=<bool>" line of the helper.
+// Lines without both values are rejected, so a partial line never keeps an old state.
+func parseMediaUsage(line string) (camera, microphone bool, ok bool) {
+	var seenCamera, seenMicrophone bool
+	for _, field := range strings.Fields(line) {
+		key, value, found := strings.Cut(field, "=")
+		if !found {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "camera":
+			camera = b
+			seenCamera = true
+		case "microphone":
+			microphone = b
+			seenMicrophone = true
+		}
 	}
+	return camera, microphone, seenCamera && seenMicrophone
+}
+
+// runSwiftHelper runs a long-lived Swift script and passes every line it prints
+// to handle, it returns when the script exits
+func runSwiftHelper(script string, handle func(line string)) error {
+	cmd := exec.Command("/usr/bin/swift", "-e", script)
 
-	// Fallback to system_profiler (RSSI is present even when SSID is redacted)
-	if rssi, ok := getRSSIFromSystemProfiler(); ok {
-		return rssi
+	env := os.Environ()
+	if cacheDir := getSwiftCacheDir(); cacheDir != "" {
+		env = append(env, "SWIFT_MODULE_CACHE_PATH="+cacheDir)
+		env = append(env, "CLANG_MODULE_CACHE_PATH="+cacheDir)
 	}
+	cmd.Env = env
 
-	// Try CoreWLAN via swift
-	if _, rssi, ok := getWiFiInfoViaSwift(); ok && rssi != "" {
-		return rssi
+	// Keep stdin open for as long as the helper should run
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
 	}
+	defer stdin.Close()
 
-	return "0"
-}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 
-func getWiFiIPAddress() string {
-	iface := getWiFiInterface()
-	if iface == "" {
-		return "Not Connected"
+	if err := cmd.Start(); err != nil {
+		return err
 	}
 
-	output := getCommandOutput("/usr/sbin/ipconfig", "getifaddr", iface)
-	if output == "" {
-		return "Not Connected"
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		handle(scanner.Text())
 	}
-	return output
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%v (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
 }
 
-func updateWiFiSSID(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/wifi_ssid", 0, false, getWiFiSSID())
-	token.Wait()
+// watchMediaUsage keeps the camera and microphone helper running
+func watchMediaUsage(client mqtt.Client) {
+	for {
+		err := runSwiftHelper(mediaUsageScript, func(line string) {
+			camera, microphone, ok := parseMediaUsage(line)
+			if !ok {
+				return
+			}
+			capture.store(camera, microphone)
+			updateMediaUsage(client)
+			requestCallUpdate()
+		})
+		if debugMode {
+			log.Printf("Warning: camera and microphone helper exited: %v", err)
+		}
+
+		capture.forget()
+		updateMediaUsage(client)
+		requestCallUpdate()
+		time.Sleep(swiftHelperRetryDelay)
+	}
 }
 
-func updateWiFiSignalStrength(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/wifi_signal_strength", 0, false, getWiFiSignalStrength())
+func updateMediaUsage(client mqtt.Client) {
+	prefix := getTopicPrefix()
+
+	camera, microphone, ok := capture.get()
+	cameraPayload, microphonePayload := "None", "None"
+	if ok {
+		cameraPayload = strconv.FormatBool(camera)
+		microphonePayload = strconv.FormatBool(microphone)
+	}
+
+	token := publishMQTT(client, prefix+"/status/camera_in_use", 0, false, cameraPayload)
 	token.Wait()
-}
 
-func updateWiFiIPAddress(client mqtt.Client) {
-	token := publishMQTT(client, getTopicPrefix()+"/status/wifi_ip", 0, false, getWiFiIPAddress())
+	token = publishMQTT(client, prefix+"/status/microphone_in_use", 0, false, microphonePayload)
 	token.Wait()
 }
 
-func getAirportInfo() string {
-	path := findAirportPath()
-	if path == "" {
+// callApp is a video-call application, detected by its process names
+type callApp struct {
+	name      string
+	processes []string
+}
+
+// callApps are checked in order, after the frontmost application
+var callApps = []callApp{
+	{name: "Zoom", processes: []string{"zoom.us"}},
+	{name: "Microsoft Teams", processes: []string{"Microsoft Teams", "MSTeams", "Microsoft Teams (work or school)"}},
+	{name: "Webex", processes: []string{"Webex", "Cisco Webex Meetings"}},
+	{name: "FaceTime", processes: []string{"FaceTime"}},
+}
+
+// callBrowsers are browsers whose tab URLs can be read through AppleScript
+var callBrowsers = []string{"Google Chrome", "Safari", "Microsoft Edge", "Brave Browser", "Arc"}
+
+// googleMeetURL matches the URL of a Google Meet meeting, not of the landing page
+var googleMeetURL = regexp.MustCompile(`meet\.google\.com/[a-z]{3}-[a-z]{4}-[a-z]{3}`)
+
+// runningAppsMaxAge is how long the list of running applications is reused
+const runningAppsMaxAge = 30 * time.Second
+
+// runningApps caches the running applications, which only change when an app
+// is launched or quit, while the call state is checked on every device change
+var runningApps struct {
+	apps    map[string]bool
+	fetched time.Time
+	mu      sync.Mutex
+}
+
+// getRunningApps returns the names of the running application processes
+func getRunningApps() (map[string]bool, error) {
+	runningApps.mu.Lock()
+	defer runningApps.mu.Unlock()
+
+	if runningApps.apps != nil && time.Since(runningApps.fetched) < runningAppsMaxAge {
+		return runningApps.apps, nil
+	}
+
+	output, err := tryGetCommandOutput("/usr/bin/osascript", "-e", "tell application \"System Events\" to get name of every application process")
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]bool)
+	for _, name := range strings.Split(output, ", ") {
+		apps[strings.TrimSpace(name)] = true
+	}
+	runningApps.apps = apps
+	runningApps.fetched = time.Now()
+	return apps, nil
+}
+
+// hasGoogleMeetTab reports whether a running browser has a Google Meet meeting open
+func hasGoogleMeetTab(running map[string]bool) (string, bool) {
+	for _, browser := range callBrowsers {
+		// Only running browsers are asked, as `tell application` would launch them
+		if !running[browser] {
+			continue
+		}
+		output, err := tryGetCommandOutput("/usr/bin/osascript", "-e", "tell application \""+browser+"\" to get URL of every tab of every window")
+		if err != nil {
+			if debugMode {
+				log.Printf("Warning: failed to get %s tabs: %v", browser, err)
+			}
+			continue
+		}
+		if googleMeetURL.MatchString(output) {
+			return browser, true
+		}
+	}
+	return "", false
+}
+
+// getCallApp returns the video-call application that is running, preferring the
+// frontmost one, or "" when none is
+func getCallApp() string {
+	running, err := getRunningApps()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to list running applications: %v", err)
+		}
 		return ""
 	}
 
-	cmd := exec.Command(path, "-I")
-	stdout, err := cmd.Output()
-	if err == nil {
-		return strings.TrimSuffix(string(stdout), "\n")
+	var found string
+	var frontmost string
+	for _, app := range callApps {
+		for _, process := range app.processes {
+			if !running[process] {
+				continue
+			}
+			// The frontmost application is only asked for once a call app runs
+			if frontmost == "" {
+				frontmost = getActiveApp()
+			}
+			if process == frontmost {
+				return app.name
+			}
+			if found == "" {
+				found = app.name
+			}
+		}
+	}
+	if found != "" {
+		return found
 	}
 
-	log.Printf("Warning: failed to run %s: %v", path, err)
+	if browser, ok := hasGoogleMeetTab(running); ok {
+		return "Google Meet (" + browser + ")"
+	}
 	return ""
 }
 
-func getSSIDFromNetworksetup() (string, bool) {
-	candidates := wifiInterfaceCandidates()
-	for i, iface := range candidates {
-		cmd := exec.Command("/usr/sbin/networksetup", "-getairportnetwork", iface)
-		stdout, err := cmd.CombinedOutput()
-		// Only log warnings for the primary interface (first candidate)
-		if err != nil && debugMode && i == 0 {
-			log.Printf("Warning: networksetup -getairportnetwork %s failed: %v", iface, err)
+// callUpdates requests an updateCall from watchCall. It holds one request, so a burst
+// of camera and microphone changes results in one lookup.
+var callUpdates = make(chan struct{}, 1)
+
+// requestCallUpdate asks watchCall to update the call state without waiting for the
+// AppleScript lookups, so neither the helper's read loop nor the ticker is held up
+func requestCallUpdate() {
+	select {
+	case callUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// watchCall updates the call state whenever it is requested
+func watchCall(client mqtt.Client) {
+	for range callUpdates {
+		updateCall(client)
+	}
+}
+
+// updateCall publishes whether a video call is in progress: the camera or the
+// microphone is in use while a video-call application is running
+func updateCall(client mqtt.Client) {
+	prefix := getTopicPrefix()
+
+	camera, microphone, ok := capture.get()
+	if !ok {
+		token := publishMQTT(client, prefix+"/status/in_call", 0, false, "None")
+		token.Wait()
+		return
+	}
+
+	// Skip the AppleScript calls while neither device is in use
+	var app string
+	if camera || microphone {
+		app = getCallApp()
+	}
+
+	attributes, _ := json.Marshal(map[string]interface{}{
+		"app":        app,
+		"camera":     camera,
+		"microphone": microphone,
+	})
+	token := publishMQTT(client, prefix+"/status/in_call_attributes", 0, false, string(attributes))
+	token.Wait()
+
+	token = publishMQTT(client, prefix+"/status/in_call", 0, false, strconv.FormatBool(app != ""))
+	token.Wait()
+}
+
+// cpuTicks holds the cumulative tick counters of one logical CPU.
+// The kernel counters are 32-bit and wrap, so deltas are computed in uint32.
+type cpuTicks struct {
+	user   uint32
+	system uint32
+	idle   uint32
+	nice   uint32
+}
+
+// cpuUsage is the share of time spent in each state between two samples, in percent
+type cpuUsage struct {
+	user   float64
+	system float64
+	idle   float64
+}
+
+func (u cpuUsage) total() float64 {
+	return 100 - u.idle
+}
+
+// cpuStats holds the previous tick sample for usage calculation
+type cpuStats struct {
+	ticks   []cpuTicks
+	overall cpuUsage
+	perCore []cpuUsage
+	valid   bool
+	mu      sync.Mutex
+}
+
+var cpuStat = &cpuStats{}
+
+var cpuWarning sync.Once
+
+// usageBetween computes the usage of one CPU from two samples
+func usageBetween(prev, cur cpuTicks) (usage cpuUsage, user, system, idle uint32) {
+	user = (cur.user - prev.user) + (cur.nice - prev.nice)
+	system = cur.system - prev.system
+	idle = cur.idle - prev.idle
+
+	total := float64(user) + float64(system) + float64(idle)
+	if total == 0 {
+		return cpuUsage{idle: 100}, 0, 0, 0
+	}
+
+	usage = cpuUsage{
+		user:   float64(user) / total * 100,
+		system: float64(system) / total * 100,
+		idle:   float64(idle) / total * 100,
+	}
+	return usage, user, system, idle
+}
+
+// updateCPUStats samples the tick counters and calculates usage since the previous sample
+func updateCPUStats() {
+	cpuStat.mu.Lock()
+	defer cpuStat.mu.Unlock()
+
+	ticks, err := getCPUTicks()
+	if err != nil {
+		// Logged once without debug mode, otherwise the CPU sensors just stay unavailable
+		cpuWarning.Do(func() {
+			log.Printf("Warning: CPU usage is unavailable: %v", err)
+		})
+		if debugMode {
+			log.Printf("Warning: failed to get CPU ticks: %v", err)
 		}
+		cpuStat.valid = false
+		return
+	}
+
+	// If this is the first measurement (or CPUs changed), just store values
+	if len(cpuStat.ticks) != len(ticks) {
+		cpuStat.ticks = ticks
+		cpuStat.valid = false
+		return
+	}
+
+	var sumUser, sumSystem, sumIdle float64
+	perCore := make([]cpuUsage, len(ticks))
+	for i := range ticks {
+		usage, user, system, idle := usageBetween(cpuStat.ticks[i], ticks[i])
+		perCore[i] = usage
+		sumUser += float64(user)
+		sumSystem += float64(system)
+		sumIdle += float64(idle)
+	}
+
+	total := sumUser + sumSystem + sumIdle
+	if total == 0 {
+		return
+	}
+
+	cpuStat.overall = cpuUsage{
+		user:   sumUser / total * 100,
+		system: sumSystem / total * 100,
+		idle:   sumIdle / total * 100,
+	}
+	cpuStat.perCore = perCore
+	cpuStat.ticks = ticks
+	cpuStat.valid = true
+}
+
+// updateCPU publishes CPU usage to MQTT
+func updateCPU(client mqtt.Client) {
+	updateCPUStats()
 
-		network := regexp.MustCompile(`Current Wi-Fi Network: (.+)`).FindStringSubmatch(string(stdout))
-		if len(network) > 1 {
-			return network[1], true
+	prefix := getTopicPrefix()
+
+	cpuStat.mu.Lock()
+	valid := cpuStat.valid
+	overall := cpuStat.overall
+	perCore := cpuStat.perCore
+	cpuStat.mu.Unlock()
+
+	if valid {
+		values := []struct {
+			topic string
+			value float64
+		}{
+			{"/status/cpu_usage", overall.total()},
+			{"/status/cpu_user", overall.user},
+			{"/status/cpu_system", overall.system},
+			{"/status/cpu_idle", overall.idle},
 		}
-		// Skip if explicitly reports not associated
-		if strings.Contains(string(stdout), "not associated") {
-			continue
+		for _, v := range values {
+			token := publishMQTT(client, prefix+v.topic, 0, false, fmt.Sprintf("%.1f", v.value))
+			token.Wait()
+		}
+
+		if cpuPerCore {
+			for i, usage := range perCore {
+				token := publishMQTT(client, fmt.Sprintf("%s/status/cpu_core_%d_usage", prefix, i), 0, false, fmt.Sprintf("%.1f", usage.total()))
+				token.Wait()
+			}
 		}
 	}
-	return "", false
 }
 
-func getWiFiInfoFromSystemProfiler() (ssid string, rssi string, ok bool) {
-	cmd := exec.Command("/usr/sbin/system_profiler", "-detailLevel", "mini", "SPAirPortDataType")
-	stdout, err := cmd.Output()
+// updateLoadAverage publishes the 1, 5 and 15 minute load averages to MQTT
+func updateLoadAverage(client mqtt.Client) {
+	loads, err := getLoadAverage()
 	if err != nil {
 		if debugMode {
-			log.Printf("Warning: system_profiler SPAirPortDataType failed: %v", err)
+			log.Printf("Warning: failed to get load average: %v", err)
+		}
+		return
+	}
+
+	prefix := getTopicPrefix()
+	for i, period := range []string{"1", "5", "15"} {
+		token := publishMQTT(client, prefix+"/status/load_"+period, 0, false, strconv.FormatFloat(loads[i], 'f', 2, 64))
+		token.Wait()
+	}
+}
+
+// memoryStats holds memory and swap usage in bytes
+type memoryStats struct {
+	total      uint64
+	used       uint64
+	free       uint64
+	wired      uint64
+	compressed uint64
+	swapUsed   uint64
+	swapTotal  uint64
+}
+
+// parseVMStat parses `vm_stat` output into page counts keyed by description,
+// e.g. "Pages wired down" => 123456, and returns the page size
+func parseVMStat(output string) (map[string]uint64, uint64) {
+	pages := make(map[string]uint64)
+	pageSize := uint64(4096)
+
+	// Mach Virtual Memory Statistics: (page size of 16384 bytes)
+	if m := regexp.MustCompile(`page size of (\d+) bytes`).FindStringSubmatch(output); m != nil {
+		pageSize, _ = strconv.ParseUint(m[1], 10, 64)
+	}
+
+	// Pages free:                               12345.
+	r := regexp.MustCompile(`^"?([^:"]+)"?:\s+(\d+)\.?$`)
+	for _, line := range strings.Split(output, "\n") {
+		m := r.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		n, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		pages[m[1]] = n
+	}
+
+	return pages, pageSize
+}
+
+// parseSwapUsage parses `sysctl vm.swapusage`, e.g.
+// total = 2048.00M  used = 1034.25M  free = 1013.75M  (encrypted)
+func parseSwapUsage(output string) (total, used uint64) {
+	units := map[string]float64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+
+	r := regexp.MustCompile(`(total|used) = ([\d.]+)([KMG])`)
+	for _, m := range r.FindAllStringSubmatch(output, -1) {
+		f, err := strconv.ParseFloat(m[2], 64)
+		if err != nil {
+			continue
+		}
+		bytes := uint64(f * units[m[3]])
+		if m[1] == "total" {
+			total = bytes
+		} else {
+			used = bytes
 		}
-		return "", "", false
 	}
 
-	output := string(stdout)
+	return total, used
+}
+
+func getMemoryStats() (memoryStats, error) {
+	var s memoryStats
+
+	memsize, err := tryGetCommandOutput("/usr/sbin/sysctl", "-n", "hw.memsize")
+	if err != nil {
+		return s, fmt.Errorf("sysctl hw.memsize failed: %w", err)
+	}
+	s.total, err = strconv.ParseUint(strings.TrimSpace(memsize), 10, 64)
+	if err != nil {
+		return s, fmt.Errorf("unexpected hw.memsize %q", memsize)
+	}
+
+	vmstat, err := tryGetCommandOutput("/usr/bin/vm_stat")
+	if err != nil {
+		return s, fmt.Errorf("vm_stat failed: %w", err)
+	}
+	pages, pageSize := parseVMStat(vmstat)
+
+	s.free = (pages["Pages free"] + pages["Pages speculative"]) * pageSize
+	s.wired = pages["Pages wired down"] * pageSize
+	s.compressed = pages["Pages occupied by compressor"] * pageSize
 
-	// Extract SSID - it appears after "Current Network Information:" on the next line
-	// Format: "          SSID_NAME:"
-	ssidMatch := regexp.MustCompile(`Current Network Information:\s+(\S+):`).FindStringSubmatch(output)
-	if len(ssidMatch) > 1 {
-		ssid = ssidMatch[1]
-		ok = true
+	// Matches Activity Monitor: app memory (anonymous minus purgeable) + wired + compressed
+	appPages := pages["Pages active"]
+	if anonymous, ok := pages["Anonymous pages"]; ok && anonymous >= pages["Pages purgeable"] {
+		appPages = anonymous - pages["Pages purgeable"]
 	}
+	s.used = appPages*pageSize + s.wired + s.compressed
 
-	// Extract RSSI
-	rssiMatch := regexp.MustCompile(`\s+RSSI: (-?\d+)`).FindStringSubmatch(output)
-	if len(rssiMatch) > 1 {
-		rssi = rssiMatch[1]
-		ok = true
+	if swap, err := tryGetCommandOutput("/usr/sbin/sysctl", "-n", "vm.swapusage"); err == nil {
+		s.swapTotal, s.swapUsed = parseSwapUsage(swap)
 	}
 
-	return ssid, rssi, ok
+	return s, nil
 }
 
-func getRSSIFromSystemProfiler() (string, bool) {
-	_, rssi, ok := getWiFiInfoFromSystemProfiler()
-	return rssi, ok
-}
+// getMemoryPressure returns the kernel memory pressure level
+// (normal, warn or critical) and the free memory percentage from memory_pressure
+func getMemoryPressure() (level string, freePercent string) {
+	if output, err := tryGetCommandOutput("/usr/sbin/sysctl", "-n", "kern.memorystatus_vm_pressure_level"); err == nil {
+		switch strings.TrimSpace(output) {
+		case "1":
+			level = "normal"
+		case "2":
+			level = "warn"
+		case "4":
+			level = "critical"
+		}
+	}
 
-// printLocationServicesInstructions provides guidance on SSID limitations
-func printLocationServicesInstructions() {
-	log.Println("╔══════════════════════════════════════════════════════════════════════════╗")
-	log.Println("║ Wi-Fi SSID is unavailable due to macOS privacy restrictions             ║")
-	log.Println("║                                                                          ║")
-	log.Println("║ Modern macOS (Ventura+) requires bundled applications with proper       ║")
-	log.Println("║ entitlements and Location Services permission to access Wi-Fi SSID.     ║")
-	log.Println("║ Command-line tools like mac2mqtt cannot satisfy these requirements.     ║")
-	log.Println("║                                                                          ║")
-	log.Println("║ Available Wi-Fi metrics without SSID:                                   ║")
-	log.Println("║ • Signal Strength (RSSI)                                                ║")
-	log.Println("║ • IP Address                                                            ║")
-	log.Println("║                                                                          ║")
-	log.Println("║ The SSID sensor will display 'Not Connected' in Home Assistant          ║")
-	log.Println("╚══════════════════════════════════════════════════════════════════════════╝")
+	// System-wide memory free percentage: 45%
+	if output, err := tryGetCommandOutput("/usr/bin/memory_pressure"); err == nil {
+		if m := regexp.MustCompile(`memory free percentage: (\d+)%`).FindStringSubmatch(output); m != nil {
+			freePercent = m[1]
+		}
+	}
+
+	return level, freePercent
 }
 
-// getWiFiInfoViaSwift uses CoreWLAN via the Swift interpreter to fetch SSID and RSSI.
-func getWiFiInfoViaSwift() (string, string, bool) {
-	script := `
-import CoreWLAN
-if let iface = CWWiFiClient.shared().interface() {
-    if let ssid = iface.ssid() {
-        print("SSID:\(ssid)")
-    }
-    print("RSSI:\(iface.rssiValue())")
+// memoryEntities are the memory sensors published in bytes; Home Assistant displays them in GiB
+var memoryEntities = []struct {
+	id    string
+	name  string
+	icon  string
+	value func(s memoryStats) uint64
+}{
+	{"memory_total", "Memory Total", "mdi:memory", func(s memoryStats) uint64 { return s.total }},
+	{"memory_used", "Memory Used", "mdi:memory", func(s memoryStats) uint64 { return s.used }},
+	{"memory_free", "Memory Free", "mdi:memory", func(s memoryStats) uint64 { return s.free }},
+	{"memory_wired", "Memory Wired", "mdi:memory", func(s memoryStats) uint64 { return s.wired }},
+	{"memory_compressed", "Memory Compressed", "mdi:memory", func(s memoryStats) uint64 { return s.compressed }},
+	{"swap_used", "Swap Used", "mdi:harddisk", func(s memoryStats) uint64 { return s.swapUsed }},
 }
-`
-	cmd := exec.Command("/usr/bin/swift", "-e", script)
 
-	cacheDir := getSwiftCacheDir()
-	env := os.Environ()
-	if cacheDir != "" {
-		env = append(env, "SWIFT_MODULE_CACHE_PATH="+cacheDir)
-		env = append(env, "CLANG_MODULE_CACHE_PATH="+cacheDir)
-	}
-	cmd.Env = env
+func updateMemory(client mqtt.Client) {
+	prefix := getTopicPrefix()
 
-	stdout, err := cmd.CombinedOutput()
+	s, err := getMemoryStats()
 	if err != nil {
 		if debugMode {
-			log.Printf("Warning: swift CoreWLAN SSID/RSSI failed: %v (%s)", err, strings.TrimSpace(string(stdout)))
+			log.Printf("Warning: failed to get memory stats: %v", err)
+		}
+	} else {
+		for _, e := range memoryEntities {
+			token := publishMQTT(client, prefix+"/status/"+e.id, 0, false, strconv.FormatUint(e.value(s), 10))
+			token.Wait()
 		}
-		return "", "", false
 	}
 
-	outStr := string(stdout)
-	ssid := regexp.MustCompile(`(?m)^SSID:(.+)$`).FindStringSubmatch(outStr)
-	rssi := regexp.MustCompile(`(?m)^RSSI:([-0-9]+)$`).FindStringSubmatch(outStr)
-
-	ssidVal := ""
-	rssiVal := ""
-	if len(ssid) > 1 {
-		ssidVal = strings.TrimSpace(ssid[1])
+	level, freePercent := getMemoryPressure()
+	if level != "" {
+		token := publishMQTT(client, prefix+"/status/memory_pressure", 0, false, level)
+		token.Wait()
 	}
-	if len(rssi) > 1 {
-		rssiVal = strings.TrimSpace(rssi[1])
+	if freePercent != "" {
+		token := publishMQTT(client, prefix+"/status/memory_free_percent", 0, false, freePercent)
+		token.Wait()
 	}
+}
 
-	if ssidVal == "" && rssiVal == "" {
-		return "", "", false
-	}
-	return ssidVal, rssiVal, true
+// volumeUsage is the space on one mounted filesystem in bytes. free is the space
+// available to unprivileged users, so used + free == total like Finder reports.
+type volumeUsage struct {
+	id         string
+	mountPoint string
+	fsType     string
+	device     string
+	total      uint64
+	free       uint64
+	used       uint64
 }
 
-func getSSIDFromIpconfig() (string, bool) {
-	candidates := wifiInterfaceCandidates()
-	for i, iface := range candidates {
-		cmd := exec.Command("/usr/sbin/ipconfig", "getsummary", iface)
-		stdout, err := cmd.CombinedOutput()
-		if err != nil {
-			// Only log warnings for the primary interface (first candidate)
-			if debugMode && i == 0 {
-				log.Printf("Warning: ipconfig getsummary %s failed: %v", iface, err)
-			}
-			continue
-		}
+func newVolumeUsage(mountPoint, fsType, device string, total, free uint64) volumeUsage {
+	v := volumeUsage{
+		id:         entitySlug(mountPoint),
+		mountPoint: mountPoint,
+		fsType:     fsType,
+		device:     device,
+		total:      total,
+		free:       free,
+	}
+	if total > free {
+		v.used = total - free
+	}
+	return v
+}
 
-		ssid := regexp.MustCompile(`(?m)SSID:\\s*(.+)`).FindStringSubmatch(string(stdout))
-		if len(ssid) > 1 {
-			return strings.TrimSpace(ssid[1]), true
-		}
+func (v volumeUsage) percent() float64 {
+	if v.total == 0 {
+		return 0
 	}
-	return "", false
+	return float64(v.used) / float64(v.total) * 100
 }
 
-var swiftCacheDir string
-var swiftCacheOnce sync.Once
+// entitySlug turns a mount point or interface name into part of an entity id:
+// "/" => "root", "/Volumes/Backup Disk" => "volumes_backup_disk"
+func entitySlug(name string) string {
+	id := strings.Trim(regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if id == "" {
+		return "root"
+	}
+	return id
+}
 
-func getSwiftCacheDir() string {
-	swiftCacheOnce.Do(func() {
-		dir, err := os.MkdirTemp("", "mac2mqtt-swiftcache")
-		if err != nil {
-			if debugMode {
-				log.Printf("Warning: unable to create Swift cache dir: %v", err)
-			}
-			swiftCacheDir = ""
-			return
-		}
-		swiftCacheDir = dir
-	})
-	return swiftCacheDir
+// volumeDetails is what `diskutil info -plist` knows about a mounted volume
+type volumeDetails struct {
+	name     string
+	location string
+	protocol string
 }
 
-// getWiFiInterface returns the device name (enX) of the Wi-Fi interface.
-func getWiFiInterface() string {
-	cmd := exec.Command("/usr/sbin/networksetup", "-listallhardwareports")
-	stdout, err := cmd.CombinedOutput()
+// getVolumeDetails asks diskutil for the volume name and whether it is internal,
+// external or a network share. Outside macOS, or for volumes diskutil does not
+// manage, the name falls back to the mount point.
+func getVolumeDetails(v volumeUsage) volumeDetails {
+	d := volumeDetails{name: filepath.Base(v.mountPoint)}
+	if v.mountPoint == "/" {
+		d.name = "Root"
+	}
+
+	output, err := tryGetCommandOutput("/usr/sbin/diskutil", "info", "-plist", v.mountPoint)
 	if err != nil {
-		if debugMode {
-			log.Printf("Warning: failed to list hardware ports: %v", err)
+		if strings.HasPrefix(v.fsType, "smbfs") || v.fsType == "afpfs" || v.fsType == "nfs" || v.fsType == "webdav" {
+			d.location = "network"
 		}
-	}
-	if len(stdout) == 0 {
-		return ""
+		return d
 	}
 
-	lines := strings.Split(string(stdout), "\n")
-	for i := 0; i < len(lines); i++ {
-		if strings.HasPrefix(lines[i], "Hardware Port: Wi-Fi") || strings.HasPrefix(lines[i], "Hardware Port: AirPort") {
-			// Next line should be "Device: enX"
-			if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "Device: ") {
-				return strings.TrimSpace(strings.TrimPrefix(lines[i+1], "Device: "))
-			}
-		}
+	plist := parsePlistDict(output)
+	if name := plist["VolumeName"]; name != "" {
+		d.name = name
+	}
+	d.protocol = plist["BusProtocol"]
+	switch {
+	case plist["Internal"] == "true":
+		d.location = "internal"
+	case plist["Internal"] == "false":
+		d.location = "external"
 	}
 
-	// Fallback to en0 if detection fails
-	return "en0"
+	return d
 }
 
-// wifiInterfaceCandidates returns possible Wi-Fi interfaces to probe.
-func wifiInterfaceCandidates() []string {
-	seen := make(map[string]bool)
-	var candidates []string
+// parsePlistDict returns the string, integer and boolean values of the top-level
+// dict in an XML property list, e.g. <key>VolumeName</key><string>Backup</string>
+func parsePlistDict(output string) map[string]string {
+	values := make(map[string]string)
 
-	add := func(iface string) {
-		if iface == "" {
-			return
+	r := regexp.MustCompile(`(?s)<key>([^<]+)</key>\s*(?:<(string|integer|real)>([^<]*)</(?:string|integer|real)>|<(true|false)/>)`)
+	for _, m := range r.FindAllStringSubmatch(output, -1) {
+		if _, ok := values[m[1]]; ok {
+			continue
 		}
-		if !seen[iface] {
-			seen[iface] = true
-			candidates = append(candidates, iface)
+		if m[4] != "" {
+			values[m[1]] = m[4]
+		} else {
+			values[m[1]] = html.UnescapeString(m[3])
 		}
 	}
 
-	// Preferred interface
-	add(getWiFiInterface())
-
-	// Common fallbacks
-	add("en0")
-	add("en1")
-	add("en2")
-	add("en3")
-
-	return candidates
+	return values
 }
 
-var airportPath string
-var airportPathOnce sync.Once
-
-func findAirportPath() string {
-	airportPathOnce.Do(func() {
-		candidates := []string{
-			"/System/Library/PrivateFrameworks/Apple80211.framework/Versions/Current/Resources/airport",
-			"/System/Library/PrivateFrameworks/Apple80211.framework/Versions/A/Resources/airport",
-		}
-
-		// Add any other versioned airport binaries if present (e.g., B, C, etc.)
-		if matches, err := filepath.Glob("/System/Library/PrivateFrameworks/Apple80211.framework/Versions/*/Resources/airport"); err == nil {
-			candidates = append(candidates, matches...)
-		}
+// diskState caches the volumes last announced to Home Assistant
+type diskState struct {
+	volumes   map[string]volumeDetails // By entity id
+	ids       map[string]string        // Entity id by mount point
+	published bool
+	restored  bool // Volumes announced before the last restart were checked
+	mu        sync.Mutex
+}
 
-		for _, p := range candidates {
-			if _, err := os.Stat(p); err == nil {
-				airportPath = p
-				return
-			}
-		}
-		airportPath = ""
-	})
+var disks = &diskState{volumes: make(map[string]volumeDetails), ids: make(map[string]string)}
 
-	return airportPath
+func (s *diskState) forgetPublished() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = false
 }
 
-// getNetworkInterfaceStats retrieves current byte counts for the Wi-Fi interface
-// Returns bytesIn, bytesOut, error
-func getNetworkInterfaceStats() (int64, int64, error) {
-	iface := getWiFiInterface()
-	if iface == "" {
-		return 0, 0, fmt.Errorf("no Wi-Fi interface found")
+// assignID returns the entity id of a mount point, which stays the same while it is
+// mounted. Mount points with the same slug, e.g. "/Volumes/My Disk" and "/Volumes/My-Disk",
+// get a numbered suffix: volumes_my_disk and volumes_my_disk_2.
+func (s *diskState) assignID(mountPoint string) string {
+	if id, ok := s.ids[mountPoint]; ok {
+		return id
 	}
 
-	cmd := exec.Command("/usr/sbin/netstat", "-ibn")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, 0, fmt.Errorf("failed to run netstat: %w", err)
+	taken := make(map[string]bool)
+	for _, id := range s.ids {
+		taken[id] = true
 	}
 
-	// Parse netstat output to find our interface
-	// Format: Name Mtu Network Address Ipkts Ierrs Ibytes Opkts Oerrs Obytes Coll
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) < 10 {
-			continue
-		}
-
-		// Check if this line is for our interface (and not a link# line)
-		if fields[0] == iface && !strings.Contains(fields[2], "Link#") {
-			// fields[6] is Ibytes (received), fields[9] is Obytes (sent)
-			ibytes, err1 := strconv.ParseInt(fields[6], 10, 64)
-			obytes, err2 := strconv.ParseInt(fields[9], 10, 64)
-
-			if err1 != nil || err2 != nil {
-				continue
-			}
-
-			return ibytes, obytes, nil
-		}
+	base := entitySlug(mountPoint)
+	id := base
+	for n := 2; taken[id]; n++ {
+		id = fmt.Sprintf("%s_%d", base, n)
 	}
-
-	return 0, 0, fmt.Errorf("interface %s not found in netstat output", iface)
+	s.ids[mountPoint] = id
+	return id
 }
 
-// updateNetworkStats updates the network statistics and calculates rates
-func updateNetworkStats() {
-	netStats.mu.Lock()
-	defer netStats.mu.Unlock()
+// store sets the entity id of every volume, looks up details for newly mounted volumes
+// and returns the ids that were unmounted, and the volumes whose sensors need (re)publishing.
+// Volumes announced before a restart that are gone now are returned as unmounted too.
+func (s *diskState) store(volumes []volumeUsage) (removed []string, added []volumeUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	bytesIn, bytesOut, err := getNetworkInterfaceStats()
-	if err != nil {
-		if debugMode {
-			log.Printf("Warning: failed to get network stats: %v", err)
+	mounted := make(map[string]bool)
+	for _, v := range volumes {
+		mounted[v.mountPoint] = true
+	}
+	for mountPoint := range s.ids {
+		if !mounted[mountPoint] {
+			delete(s.ids, mountPoint)
 		}
-		// Reset rates on error
-		netStats.uploadRate = 0
-		netStats.downloadRate = 0
-		return
 	}
 
-	now := time.Now()
-
-	// If this is the first measurement, just store values
-	if netStats.timestamp.IsZero() {
-		netStats.bytesIn = bytesIn
-		netStats.bytesOut = bytesOut
-		netStats.timestamp = now
-		netStats.uploadRate = 0
-		netStats.downloadRate = 0
-		return
+	current := make(map[string]bool)
+	for i := range volumes {
+		volumes[i].id = s.assignID(volumes[i].mountPoint)
+		v := volumes[i]
+		current[v.id] = true
+		if _, ok := s.volumes[v.id]; !ok || !s.published {
+			added = append(added, v)
+		}
 	}
 
-	// Calculate time difference in seconds
-	timeDiff := now.Sub(netStats.timestamp).Seconds()
-	if timeDiff <= 0 {
-		return
+	for id := range s.volumes {
+		if !current[id] {
+			removed = append(removed, id)
+			delete(s.volumes, id)
+		}
 	}
 
-	// Calculate byte differences
-	bytesDiffIn := bytesIn - netStats.bytesIn
-	bytesDiffOut := bytesOut - netStats.bytesOut
-
-	// Handle counter overflow or reset (negative difference)
-	if bytesDiffIn < 0 {
-		bytesDiffIn = 0
+	if !s.restored {
+		for _, id := range state.diskVolumes() {
+			if !current[id] {
+				removed = append(removed, id)
+			}
+		}
+		s.restored = true
 	}
-	if bytesDiffOut < 0 {
-		bytesDiffOut = 0
+
+	ids := make([]string, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
 	}
+	state.setDiskVolumes(ids)
 
-	// Calculate rates in bytes per second
-	netStats.downloadRate = float64(bytesDiffIn) / timeDiff
-	netStats.uploadRate = float64(bytesDiffOut) / timeDiff
+	for _, v := range added {
+		if _, ok := s.volumes[v.id]; !ok {
+			s.volumes[v.id] = getVolumeDetails(v)
+		}
+	}
 
-	// Update stored values
-	netStats.bytesIn = bytesIn
-	netStats.bytesOut = bytesOut
-	netStats.timestamp = now
+	s.published = true
+	return removed, added
 }
 
-// getNetworkUploadRate returns the current upload rate in KB/s
-func getNetworkUploadRate() string {
-	netStats.mu.Lock()
-	defer netStats.mu.Unlock()
+func (s *diskState) details(id string) volumeDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.volumes[id]
+}
 
-	// Convert bytes/s to KB/s and round to 2 decimal places
-	kbps := netStats.uploadRate / 1024.0
-	return fmt.Sprintf("%.2f", kbps)
+// diskEntities are the sensors published for each mounted volume
+var diskEntities = []struct {
+	id   string
+	name string
+}{
+	{"used", "Disk Used"},
+	{"free", "Disk Free"},
+	{"total", "Disk Total"},
+	{"percent", "Disk Usage"},
 }
 
-// getNetworkDownloadRate returns the current download rate in KB/s
-func getNetworkDownloadRate() string {
-	netStats.mu.Lock()
-	defer netStats.mu.Unlock()
+func publishDiskSensors(client mqtt.Client, v volumeUsage, d volumeDetails) {
+	prefix := getTopicPrefix()
+	device := getDeviceInfo()
+
+	for _, e := range diskEntities {
+		id := "disk_" + v.id + "_" + e.id
+		diskConfig := map[string]interface{}{
+			"name":                  d.name + " " + e.name,
+			"unique_id":             "mac2mqtt_" + hostname + "_" + id,
+			"state_topic":           prefix + "/status/" + id,
+			"state_class":           "measurement",
+			"icon":                  "mdi:harddisk",
+			"availability_topic":    prefix + "/status/alive",
+			"payload_available":     "true",
+			"payload_not_available": "false",
+			"device":                device,
+		}
+		if e.id == "percent" {
+			diskConfig["unit_of_measurement"] = "%"
+			diskConfig["suggested_display_precision"] = 1
+			diskConfig["json_attributes_topic"] = prefix + "/status/disk_" + v.id + "_attributes"
+		} else {
+			diskConfig["unit_of_measurement"] = "B"
+			diskConfig["device_class"] = "data_size"
+			diskConfig["suggested_unit_of_measurement"] = "GB"
+			diskConfig["suggested_display_precision"] = 1
+		}
+		if d.location == "network" {
+			diskConfig["icon"] = "mdi:nas"
+		} else if d.location == "external" {
+			diskConfig["icon"] = "mdi:harddisk-plus"
+		}
+		publishConfig(client, "sensor", hostname+"_"+id, diskConfig)
+	}
 
-	// Convert bytes/s to KB/s and round to 2 decimal places
-	kbps := netStats.downloadRate / 1024.0
-	return fmt.Sprintf("%.2f", kbps)
+	attributes, _ := json.Marshal(map[string]interface{}{
+		"mount_point": v.mountPoint,
+		"filesystem":  v.fsType,
+		"device":      v.device,
+		"location":    d.location,
+		"protocol":    d.protocol,
+	})
+	token := publishMQTT(client, prefix+"/status/disk_"+v.id+"_attributes", 0, true, string(attributes))
+	token.Wait()
 }
 
-// updateNetworkActivity publishes network activity to MQTT
-func updateNetworkActivity(client mqtt.Client) {
-	// First update the stats
-	updateNetworkStats()
+func updateDisks(client mqtt.Client) {
+	volumes, err := getMountedVolumes()
+	if err != nil {
+		if debugMode {
+			log.Printf("Warning: failed to get mounted volumes: %v", err)
+		}
+		return
+	}
 
-	// Then publish the rates
 	prefix := getTopicPrefix()
 
-	uploadToken := publishMQTT(client, prefix+"/status/network_upload_rate", 0, false, getNetworkUploadRate())
-	uploadToken.Wait()
+	removed, added := disks.store(volumes)
+	for _, id := range removed {
+		for _, e := range diskEntities {
+			removeConfig(client, "sensor", hostname+"_disk_"+id+"_"+e.id)
+		}
+		token := publishMQTT(client, prefix+"/status/disk_"+id+"_attributes", 0, true, "")
+		token.Wait()
+	}
+	for _, v := range added {
+		publishDiskSensors(client, v, disks.details(v.id))
+	}
+	if len(removed) > 0 || len(added) > 0 {
+		publishCapabilities(client)
+	}
 
-	downloadToken := publishMQTT(client, prefix+"/status/network_download_rate", 0, false, getNetworkDownloadRate())
-	downloadToken.Wait()
+	for _, v := range volumes {
+		values := map[string]string{
+			"used":    strconv.FormatUint(v.used, 10),
+			"free":    strconv.FormatUint(v.free, 10),
+			"total":   strconv.FormatUint(v.total, 10),
+			"percent": strconv.FormatFloat(v.percent(), 'f', 1, 64),
+		}
+		for _, e := range diskEntities {
+			token := publishMQTT(client, prefix+"/status/disk_"+v.id+"_"+e.id, 0, false, values[e.id])
+			token.Wait()
+		}
+	}
 }
 
 func getBatteryTemperature() string {
-	output, err := tryGetCommandOutput("/usr/sbin/ioreg", "-rn", "AppleSmartBattery", "-k", "Temperature")
-	if err != nil {
-		return ""
-	}
-
-	r := regexp.MustCompile(`"Temperature" = (\d+)`)
-	matches := r.FindStringSubmatch(output)
-	if len(matches) < 2 {
+	if !hasBattery() {
 		return ""
 	}
 
-	raw, err := strconv.ParseFloat(matches[1], 64)
-	if err != nil {
+	b, err := getSmartBattery()
+	if err != nil || b.temperature == 0 {
 		return ""
 	}
 
-	return fmt.Sprintf("%.1f", raw/100.0)
+	return fmt.Sprintf("%.1f", b.temperature)
 }
 
 var powermetricsWarningOnce sync.Once
@@ -1428,6 +7198,122 @@ func updateTemperatures(client mqtt.Client) {
 	}
 }
 
+// stateFile persists counters across restarts, next to mac2mqtt.yaml
+const stateFile = "mac2mqtt.state.json"
+
+// persistentState holds values that must survive agent restarts and reboots
+type persistentState struct {
+	EnergyKWh            float64  `json:"energy_kwh"`
+	NetworkBytesReceived uint64   `json:"network_bytes_received"`
+	NetworkBytesSent     uint64   `json:"network_bytes_sent"`
+	DiskVolumes          []string `json:"disk_volumes"` // Entity ids of the announced volumes
+
+	dirty bool
+	mu    sync.Mutex
+}
+
+var state = &persistentState{}
+
+func (s *persistentState) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read %s: %v", stateFile, err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		log.Printf("Warning: failed to parse %s: %v", stateFile, err)
+	}
+}
+
+// save writes the state if it changed, via a temporary file so a crash never leaves it truncated
+func (s *persistentState) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling state: %v", err)
+		return
+	}
+
+	tmpPath := stateFile + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("Warning: failed to write %s: %v", tmpPath, err)
+		return
+	}
+	if err := os.Rename(tmpPath, stateFile); err != nil {
+		log.Printf("Warning: failed to replace %s: %v", stateFile, err)
+		return
+	}
+
+	s.dirty = false
+}
+
+func (s *persistentState) addEnergy(kwh float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.EnergyKWh += kwh
+	s.dirty = true
+}
+
+func (s *persistentState) energy() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.EnergyKWh
+}
+
+func (s *persistentState) addNetworkBytes(received, sent uint64) {
+	if received == 0 && sent == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.NetworkBytesReceived += received
+	s.NetworkBytesSent += sent
+	s.dirty = true
+}
+
+func (s *persistentState) networkBytes() (received, sent uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.NetworkBytesReceived, s.NetworkBytesSent
+}
+
+func (s *persistentState) diskVolumes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.DiskVolumes...)
+}
+
+func (s *persistentState) setDiskVolumes(ids []string) {
+	sort.Strings(ids)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.Join(ids, "\n") == strings.Join(s.DiskVolumes, "\n") {
+		return
+	}
+	s.DiskVolumes = ids
+	s.dirty = true
+}
+
 // GitHubRelease represents a GitHub release response
 type GitHubRelease struct {
 	TagName    string        `json:"tag_name"`
@@ -1683,6 +7569,8 @@ func replaceBinary(newBinaryPath string) error {
 // restartSelf exits cleanly to allow launchd to restart with new binary
 func restartSelf() error {
 	log.Println("Exiting to allow launchd restart with new binary")
+	// Keep the traffic and energy totals counted since the last periodic save
+	state.save()
 	os.Exit(0)
 	return nil // Never reached
 }
@@ -1760,13 +7648,22 @@ func main() {
 
 	var c config
 	c.getConfig()
+	state.load()
 
 	var wg sync.WaitGroup
 
 	hostname = getHostname()
+	registerCommands()
 	mqttClient := getMQTTClient(c.Ip, c.Port, c.User, c.Password)
 
+	// Camera and microphone state and Wi-Fi changes are pushed by helpers instead of polled
+	go watchMediaUsage(mqttClient)
+	go watchCall(mqttClient)
+	go watchWiFi(mqttClient)
+
 	volumeTicker := time.NewTicker(2 * time.Second)
+	hardwareTicker := time.NewTicker(60 * time.Second)
+	deviceTicker := time.NewTicker(10 * time.Second)
 	batteryTicker := time.NewTicker(60 * time.Second)
 	updateTicker := time.NewTicker(1 * time.Hour)
 
@@ -1784,23 +7681,56 @@ func main() {
 		log.Println("Auto-update disabled")
 	}
 
+	// system_profiler takes up to seconds, so audio devices and displays are
+	// polled on their own and never delay the other updates
+	go func() {
+		for range hardwareTicker.C {
+			updateAudioDevices(mqttClient)
+			updateDisplays(mqttClient)
+		}
+	}()
+
+	// The counters are saved every minute, and on shutdown (launchd sends SIGTERM) so
+	// the total_increasing sensors don't go backwards after a restart
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
 	wg.Add(1)
 	go func() {
 		for {
 			select {
+			case sig := <-signals:
+				log.Printf("Received %v, exiting", sig)
+				state.save()
+				os.Exit(0)
+
 			case _ = <-volumeTicker.C:
-				updateVolume(mqttClient)
-				updateMute(mqttClient)
+				updateVolumeSettings(mqttClient)
 				updateActiveApp(mqttClient)
+				updateNowPlaying(mqttClient)
 				updateNetworkActivity(mqttClient)
+				updateCPU(mqttClient)
+
+			case _ = <-deviceTicker.C:
+				updateBrightness(mqttClient)
+				updatePowerSource(mqttClient)
+				updatePower(mqttClient)
+				updateLoadAverage(mqttClient)
+				updateMemory(mqttClient)
+				updateDisks(mqttClient)
+				updateNetworkInfo(mqttClient)
+				updateVPN(mqttClient)
+				updateBrokerHealth(mqttClient)
+				updateRadios(mqttClient)
+				requestCallUpdate()
 
 			case _ = <-batteryTicker.C:
 				updateBattery(mqttClient)
-				updateWiFiSSID(mqttClient)
-				updateWiFiSignalStrength(mqttClient)
-				updateWiFiIPAddress(mqttClient)
+				updateWiFi(mqttClient)
+				updateBluetooth(mqttClient)
 				updateSystemUptime(mqttClient)
 				updateTemperatures(mqttClient)
+				state.save()
 
 			case _ = <-updateTicker.C:
 				if autoUpdateEnabled {
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPayloadSchemaParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  payloadSchema
+		payload string
+		want    interface{}
+		wantErr bool
+	}{
+		{"int", intSchema(0, 100), "42", 42, false},
+		{"int with spaces", intSchema(0, 100), " 7\n", 7, false},
+		{"int minimum", intSchema(0, 100), "0", 0, false},
+		{"int maximum", intSchema(0, 100), "100", 100, false},
+		{"int below minimum", intSchema(0, 100), "-1", nil, true},
+		{"int above maximum", intSchema(0, 100), "101", nil, true},
+		{"int not a number", intSchema(0, 100), "loud", nil, true},
+		{"int empty", intSchema(0, 100), "", nil, true},
+		{"bool true", boolSchema(), "true", true, false},
+		{"bool numeric", boolSchema(), "0", false, false},
+		{"bool invalid", boolSchema(), "on", nil, true},
+		{"enum", enumSchema("sleep", "shutdown"), "sleep", "sleep", false},
+		{"enum is case sensitive", enumSchema("sleep", "shutdown"), "Sleep", nil, true},
+		{"enum unknown", enumSchema("sleep", "shutdown"), "reboot", nil, true},
+		{"json object", jsonSchema(), `{"a":1}`, json.RawMessage(`{"a":1}`), false},
+		{"json invalid", jsonSchema(), `{"a":`, nil, true},
+		{"pattern", patternSchema(`^[+-]\d+$`), "+5", "+5", false},
+		{"pattern no match", patternSchema(`^[+-]\d+$`), "5", nil, true},
+		{"one_of relative", volumeValueSchema, "-10", "-10", false},
+		{"one_of absolute", volumeValueSchema, "50", 50, false},
+		{"one_of step", volumeValueSchema, "up", "up", false},
+		{"one_of out of range", volumeValueSchema, "200", nil, true},
+		{"one_of json", volumeSchema, `{"volume":30,"fade":5}`, json.RawMessage(`{"volume":30,"fade":5}`), false},
+		{"unknown type", payloadSchema{Type: "float"}, "1", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.schema.parse(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse(%q) error = %v, wantErr %v", tt.payload, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse(%q) = %#v, want %#v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSmartBattery(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   smartBattery
+	}{
+		{
+			name: "apple silicon discharging",
+			output: `+-o AppleSmartBattery  <class AppleSmartBattery, id 0x100000264, registered, matched, active, busy 0 (0 ms), retain 7>
+    {
+      "BatteryInstalled" = Yes
+      "ExternalConnected" = No
+      "IsCharging" = No
+      "FullyCharged" = No
+      "CycleCount" = 123
+      "DesignCapacity" = 6075
+      "MaxCapacity" = 100
+      "CurrentCapacity" = 57
+      "AppleRawMaxCapacity" = 5512
+      "AppleRawCurrentCapacity" = 3141
+      "AvgTimeToEmpty" = 245
+      "AvgTimeToFull" = 65535
+      "Voltage" = 11876
+      "Amperage" = 18446744073709550616
+      "Temperature" = 3071
+      "PowerTelemetryData" = {"SystemPowerIn"=0,"SystemLoad"=11876}
+      "BatteryData" = {"CycleCount"=999,"DesignCapacity"=1}
+    }`,
+			want: smartBattery{
+				installed:       true,
+				cycleCount:      123,
+				designCapacity:  6075,
+				maxCapacity:     5512,
+				currentCapacity: 3141,
+				timeToEmpty:     245,
+				timeToFull:      -1,
+				voltage:         11876,
+				amperage:        -1000,
+				temperature:     30.71,
+				systemPowerIn:   0,
+			},
+		},
+		{
+			name: "intel charging on an adapter",
+			output: `    {
+      "BatteryInstalled" = Yes
+      "ExternalConnected" = Yes
+      "IsCharging" = Yes
+      "FullyCharged" = No
+      "CycleCount" = 812
+      "DesignCapacity" = 8790
+      "MaxCapacity" = 7405
+      "CurrentCapacity" = 3702
+      "AvgTimeToEmpty" = 65535
+      "AvgTimeToFull" = 94
+      "Voltage" = 12603
+      "Amperage" = 2980
+      "AdapterDetails" = {"Watts"=87,"Name"="87W USB-C Power Adapter"}
+    }`,
+			want: smartBattery{
+				installed:         true,
+				isCharging:        true,
+				externalConnected: true,
+				cycleCount:        812,
+				designCapacity:    8790,
+				maxCapacity:       7405,
+				currentCapacity:   3702,
+				timeToEmpty:       -1,
+				timeToFull:        94,
+				voltage:           12603,
+				amperage:          2980,
+				systemPowerIn:     -1,
+				adapterWatts:      87,
+			},
+		},
+		{
+			name:   "no battery",
+			output: "",
+			want:   smartBattery{timeToEmpty: -1, timeToFull: -1, systemPowerIn: -1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseSmartBattery(parseIORegRecord(tt.output))
+			if got != tt.want {
+				t.Errorf("parseSmartBattery() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNetstat(t *testing.T) {
+	output := `Name       Mtu   Network       Address            Ipkts Ierrs     Ibytes    Opkts Oerrs     Obytes  Coll
+lo0        16384 <Link#1>                         12345     0    2345678    12345     0    2345678     0
+lo0        16384 127           127.0.0.1          12345     -    2345678    12345     -    2345678     -
+en0        1500  <Link#11>   aa:bb:cc:dd:ee:ff  1234567     3 1234567890   765432     1  987654321     0
+en0        1500  192.168.1     192.168.1.20     1200000     -  120000000   700000     -   90000000     -
+en5*       1500  <Link#15>   11:22:33:44:55:66        0     0          0        0     0          0     0
+utun3      1380  <Link#20>                          42     0       4200       40     0       4000     0
+bad        1500  <Link#30>   11:22:33:44:55:77        x     0          0        0     0          0     0
+`
+
+	want := map[string]interfaceCounters{
+		"lo0":   {packetsIn: 12345, bytesIn: 2345678, packetsOut: 12345, bytesOut: 2345678},
+		"en0":   {packetsIn: 1234567, errorsIn: 3, bytesIn: 1234567890, packetsOut: 765432, errorsOut: 1, bytesOut: 987654321},
+		"en5":   {},
+		"utun3": {packetsIn: 42, bytesIn: 4200, packetsOut: 40, bytesOut: 4000},
+	}
+
+	got := parseNetstat(output)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNetstat() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		prev, cur uint64
+		want      uint64
+	}{
+		{"growth", 1000, 1500, 500},
+		{"unchanged", 1000, 1000, 0},
+		{"reset", 1000, 200, 200},
+		{"reset to zero", 1000, 0, 0},
+		{"near the maximum", 1<<64 - 10, 1<<64 - 1, 9},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := counterDelta(tt.prev, tt.cur); got != tt.want {
+				t.Errorf("counterDelta(%d, %d) = %d, want %d", tt.prev, tt.cur, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkRateUnits(t *testing.T) {
+	tests := []struct {
+		setting  string
+		want     string // 1,000,000 bytes per second
+		dataRate bool
+	}{
+		{"B/s", "1000000", true},
+		{"KB/s", "976.56", false},
+		{"kB/s", "1000.00", true},
+		{"MB/s", "1.00", true},
+		{"KiB/s", "976.56", true},
+		{"MiB/s", "0.95", true},
+		{"kbit/s", "8000.0", true},
+		{"Mbit/s", "8.00", true},
+	}
+
+	if len(tests) != len(networkRateUnits) {
+		t.Errorf("%d units tested, %d defined", len(tests), len(networkRateUnits))
+	}
+
+	defer func(unit networkRateUnit) { networkRate = unit }(networkRate)
+
+	upload := networkRateEntities[0]
+	for _, tt := range tests {
+		t.Run(tt.setting, func(t *testing.T) {
+			unit, ok := networkRateUnits[tt.setting]
+			if !ok {
+				t.Fatalf("no unit for %q", tt.setting)
+			}
+			if unit.name != tt.setting {
+				t.Errorf("unit name = %q, want %q", unit.name, tt.setting)
+			}
+			if unit.dataRate != tt.dataRate {
+				t.Errorf("dataRate = %v, want %v", unit.dataRate, tt.dataRate)
+			}
+
+			networkRate = unit
+			if got := upload.format(interfaceRates{upload: 1000000}); got != tt.want {
+				t.Errorf("format() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWiFiEvent(t *testing.T) {
+	home := wifiInfo{connected: true, ssid: "Home", bssid: "aa:bb:cc:dd:ee:01", channel: 36}
+	redacted := wifiInfo{connected: true, ssid: "Home", bssid: "<redacted>", channel: 36}
+	down := wifiInfo{}
+
+	with := func(w wifiInfo, change func(*wifiInfo)) wifiInfo {
+		change(&w)
+		return w
+	}
+
+	tests := []struct {
+		name              string
+		previous, current wifiInfo
+		bssidChanged      bool
+		want              string
+	}{
+		{"unchanged", home, home, false, ""},
+		{"disconnected", home, down, false, "disconnected"},
+		{"connected", down, home, false, "connected"},
+		{"still down", down, down, true, ""},
+		{"joined another network", home, with(home, func(w *wifiInfo) { w.ssid = "Office" }), false, "connected"},
+		{"roamed", home, with(home, func(w *wifiInfo) { w.bssid = "aa:bb:cc:dd:ee:02" }), false, "roamed"},
+		{"same access point despite the event", home, home, true, ""},
+		{"redacted roam from the event", redacted, redacted, true, "roamed"},
+		{"redacted without an event", redacted, redacted, false, ""},
+		{"redacted channel change", redacted, with(redacted, func(w *wifiInfo) { w.channel = 100 }), false, ""},
+		{"channel change", home, with(home, func(w *wifiInfo) { w.channel = 100 }), false, ""},
+		{"signal change", home, with(home, func(w *wifiInfo) { w.rssi = -70 }), false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wifiEvent(tt.previous, tt.current, tt.bssidChanged); got != tt.want {
+				t.Errorf("wifiEvent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMediaUsage(t *testing.T) {
+	tests := []struct {
+		line                   string
+		camera, microphone, ok bool
+	}{
+		{"camera=true microphone=false", true, false, true},
+		{"camera=false microphone=true", false, true, true},
+		{"microphone=1 camera=0", false, true, true},
+		{"  camera=false   microphone=false\r", false, false, true},
+		{"camera=true", true, false, false},
+		{"microphone=true", false, true, false},
+		{"camera=maybe microphone=true", false, true, false},
+		{"warning: deprecated API", false, false, false},
+		{"", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			camera, microphone, ok := parseMediaUsage(tt.line)
+			if ok != tt.ok {
+				t.Fatalf("parseMediaUsage(%q) ok = %v, want %v", tt.line, ok, tt.ok)
+			}
+			if ok && (camera != tt.camera || microphone != tt.microphone) {
+				t.Errorf("parseMediaUsage(%q) = %v, %v, want %v, %v", tt.line, camera, microphone, tt.camera, tt.microphone)
+			}
+		})
+	}
+}